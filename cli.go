@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/hidden"
+
+	"github.com/getlantern/go-geoserve/geoserve"
+)
+
+// cliDBTimeout is how long the lookup command waits for the database to
+// download when DB isn't set
+const cliDBTimeout = 5 * time.Minute
+
+// cliResult is the line printed for each ip by the lookup command
+type cliResult struct {
+	IP     string          `json:"ip"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// runLookup geolocates ips using the database from DB or DB_URL and prints one
+// {"ip":...,"result":...} JSON object per ip to stdout. It returns the exit
+// code for the process, which is 1 if any lookup failed.
+func runLookup(ips []string) int {
+	if len(ips) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: go-geoserve lookup <ip> [<ip>...]")
+		return 2
+	}
+	// Keep stdout for results
+	golog.SetOutputs(os.Stderr, os.Stderr)
+
+	// A one-shot lookup only needs the database from DB_URL if there's no DB
+	// file, and no updates after that
+	dbFile, dbURL := os.Getenv("DB"), os.Getenv("DB_URL")
+	if dbFile != "" {
+		dbURL = ""
+	} else if dbURL == "" {
+		fmt.Fprintln(os.Stderr, "Unable to load database: neither DB nor DB_URL is set")
+		return 1
+	}
+	geoServer, err := geoserve.NewServer(dbFile, dbURL, serverOptions()...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to load database: %v\n", hidden.Clean(err.Error()))
+		return 1
+	}
+	defer geoServer.Close()
+	err = geoServer.WaitForDB(cliDBTimeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to load database: %v\n", hidden.Clean(err.Error()))
+		return 1
+	}
+
+	exitCode := 0
+	enc := json.NewEncoder(os.Stdout)
+	for _, ip := range ips {
+		res := &cliResult{IP: ip}
+		jsonData, err := geoServer.LookupJSON(ip)
+		if err != nil {
+			res.Error = hidden.Clean(err.Error())
+			exitCode = 1
+		} else {
+			res.Result = jsonData
+		}
+		err = enc.Encode(res)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to write result: %v\n", err)
+			return 1
+		}
+	}
+	return exitCode
+}
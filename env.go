@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// intFromEnv reads an integer from the named environment variable, returning
+// def if it's unset. Invalid values are fatal.
+func intFromEnv(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Invalid %v %v: %v", name, value, err)
+	}
+	return n
+}
+
+// floatFromEnv reads a float from the named environment variable, returning
+// def if it's unset. Invalid values are fatal.
+func floatFromEnv(name string, def float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Fatalf("Invalid %v %v: %v", name, value, err)
+	}
+	return f
+}
+
+// durationFromEnv reads a duration like "90s" from the named environment
+// variable, returning def if it's unset. Invalid values are fatal.
+func durationFromEnv(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid %v %v: %v", name, value, err)
+	}
+	return d
+}
@@ -0,0 +1,92 @@
+package geoserve
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/getlantern/golog"
+)
+
+// accessLog logs one line per lookup when request logging is enabled
+var accessLog = golog.LoggerFor("go-geoserve.access")
+
+// accessLogEntry collects what's logged about a lookup handled by Handle. A
+// nil entry, as used when request logging is disabled, ignores everything.
+type accessLogEntry struct {
+	resp     *statusRecorder
+	start    time.Time
+	clientIP string
+	ip       string
+	country  string
+}
+
+// statusRecorder remembers the status of the response written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// startAccessLog starts the access log entry for req, returning the
+// ResponseWriter through which to respond so that the status is recorded. The
+// entry is nil if request logging is disabled.
+func (server *GeoServer) startAccessLog(resp http.ResponseWriter, req *http.Request) (http.ResponseWriter, *accessLogEntry) {
+	if !server.logRequests {
+		return resp, nil
+	}
+	recorder := &statusRecorder{ResponseWriter: resp}
+	return recorder, &accessLogEntry{
+		resp:     recorder,
+		start:    time.Now(),
+		clientIP: server.ClientIP(req),
+	}
+}
+
+// setIP records the ip being looked up
+func (e *accessLogEntry) setIP(ip string) {
+	if e != nil {
+		e.ip = ip
+	}
+}
+
+// setResult records the country of the lookup result
+func (e *accessLogEntry) setResult(res *result) {
+	if e != nil && res != nil {
+		e.country = countryIsoCode(res.record)
+	}
+}
+
+// log logs the entry as space-separated key=value pairs, with "-" for values
+// that weren't determined, e.g.
+// client=203.0.113.7 ip=66.69.242.177 country=US cache=HIT status=200 latency=0.215ms
+func (e *accessLogEntry) log() {
+	if e == nil {
+		return
+	}
+	orDash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+	status := e.resp.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	accessLog.Debugf("client=%v ip=%v country=%v cache=%v status=%d latency=%.3fms",
+		orDash(e.clientIP), orDash(e.ip), orDash(e.country), orDash(e.resp.Header().Get("X-Cache")),
+		status, float64(time.Since(e.start))/float64(time.Millisecond))
+}
@@ -0,0 +1,128 @@
+package geoserve
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// AdminTokenHeader is the request header carrying the shared secret for
+	// admin endpoints
+	AdminTokenHeader = "X-Admin-Token"
+
+	// DefaultLogBufferSize is the number of lines a LogBuffer keeps unless
+	// told otherwise
+	DefaultLogBufferSize = 1000
+
+	defaultLogLines = 100
+	logsInterval    = 1 * time.Second
+)
+
+// RequireAdmin wraps handler so that it only serves requests carrying the
+// given admin token in the X-Admin-Token header. All other requests get 401.
+func RequireAdmin(token string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		supplied := req.Header.Get(AdminTokenHeader)
+		if token == "" || subtle.ConstantTimeCompare([]byte(supplied), []byte(token)) != 1 {
+			resp.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(resp, req)
+	})
+}
+
+// LogBuffer is an io.Writer that keeps the most recent lines written to it in
+// a ring buffer, for serving logs over HTTP.
+type LogBuffer struct {
+	mx          sync.Mutex
+	lines       []string
+	next        int
+	full        bool
+	partial     string
+	lastRequest time.Time
+}
+
+// NewLogBuffer constructs a LogBuffer that keeps the last size lines. A size
+// below 1 keeps DefaultLogBufferSize lines.
+func NewLogBuffer(size int) *LogBuffer {
+	if size < 1 {
+		log.Errorf("Invalid log buffer size %d, keeping %d lines", size, DefaultLogBufferSize)
+		size = DefaultLogBufferSize
+	}
+	return &LogBuffer{lines: make([]string, size)}
+}
+
+// Write implements io.Writer
+func (b *LogBuffer) Write(p []byte) (int, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	text := b.partial + string(p)
+	for {
+		i := strings.IndexByte(text, '\n')
+		if i < 0 {
+			break
+		}
+		b.lines[b.next] = text[:i]
+		b.next = (b.next + 1) % len(b.lines)
+		if b.next == 0 {
+			b.full = true
+		}
+		text = text[i+1:]
+	}
+	b.partial = text
+	return len(p), nil
+}
+
+// Lines returns up to the last n complete lines, oldest first
+func (b *LogBuffer) Lines(n int) []string {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	count := b.next
+	if b.full {
+		count = len(b.lines)
+	}
+	if n > count {
+		n = count
+	}
+	result := make([]string, 0, n)
+	for i := b.next - n; i < b.next; i++ {
+		result = append(result, b.lines[(i+len(b.lines))%len(b.lines)])
+	}
+	return result
+}
+
+// ServeHTTP serves the last lines of the log as text, ?n=<lines> (default 100).
+// Requests are limited to one per second. This should be wrapped with
+// RequireAdmin.
+func (b *LogBuffer) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	b.mx.Lock()
+	now := time.Now()
+	tooSoon := now.Sub(b.lastRequest) < logsInterval
+	if !tooSoon {
+		b.lastRequest = now
+	}
+	b.mx.Unlock()
+	if tooSoon {
+		resp.Header().Set("Retry-After", "1")
+		resp.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	n := defaultLogLines
+	if lines := req.URL.Query().Get("n"); lines != "" {
+		var err error
+		n, err = strconv.Atoi(lines)
+		if err != nil || n < 0 {
+			http.Error(resp, "n must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+	}
+	resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, line := range b.Lines(n) {
+		resp.Write([]byte(line + "\n"))
+	}
+}
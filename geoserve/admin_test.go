@@ -0,0 +1,26 @@
+package geoserve
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogBuffer(t *testing.T) {
+	b := NewLogBuffer(2)
+	b.Write([]byte("one\ntwo\nthr"))
+	assert.Equal(t, []string{"one", "two"}, b.Lines(10))
+	b.Write([]byte("ee\n"))
+	assert.Equal(t, []string{"two", "three"}, b.Lines(10))
+	assert.Equal(t, []string{"three"}, b.Lines(1))
+}
+
+func TestLogBufferInvalidSize(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		b := NewLogBuffer(size)
+		assert.NotPanics(t, func() {
+			b.Write([]byte("line\n"))
+		})
+		assert.Equal(t, []string{"line"}, b.Lines(10))
+	}
+}
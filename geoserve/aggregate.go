@@ -0,0 +1,92 @@
+package geoserve
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+
+	geoip2 "github.com/oschwald/geoip2-golang"
+)
+
+// Fields that the geolocations of multiple ips can be aggregated by
+const (
+	AggregateCountry   = "country"
+	AggregateRegion    = "region"
+	AggregateContinent = "continent"
+)
+
+// unknownAggregateKey counts the ips for which the aggregated field is unknown
+const unknownAggregateKey = "unknown"
+
+// aggregation counts ips by the value of a field of their geolocation
+type aggregation struct {
+	Aggregate string         `json:"aggregate"`
+	Counts    map[string]int `json:"counts"`
+	Failed    int            `json:"failed,omitempty"`
+}
+
+func validAggregate(by string) bool {
+	return by == AggregateCountry || by == AggregateRegion || by == AggregateContinent
+}
+
+// aggregate looks up ips and counts them by country ISO code, region (as
+// <country>-<subdivision> ISO codes, e.g. US-TX) or continent code. Lookups
+// that fail, and invalid ips, are counted separately.
+func (server *GeoServer) aggregate(ips []string, by string) *aggregation {
+	agg := &aggregation{Aggregate: by, Counts: make(map[string]int)}
+	for _, ip := range ips {
+		if net.ParseIP(ip) == nil {
+			agg.Failed++
+			continue
+		}
+		// Regions need city data, which brief lookups use when available
+		gr := server.query(get{ip: ip, brief: by == AggregateRegion, country: by != AggregateRegion})
+		if gr.res == nil {
+			agg.Failed++
+			continue
+		}
+		key := aggregateKey(gr.res.record, by)
+		if key == "" {
+			key = unknownAggregateKey
+		}
+		agg.Counts[key]++
+	}
+	return agg
+}
+
+func aggregateKey(record interface{}, by string) string {
+	switch by {
+	case AggregateRegion:
+		b := briefOf(record)
+		if b.Country == "" || b.Region == "" {
+			return ""
+		}
+		return b.Country + "-" + b.Region
+	case AggregateContinent:
+		switch r := record.(type) {
+		case *geoip2.City:
+			return r.Continent.Code
+		case *geoip2.Country:
+			return r.Continent.Code
+		}
+		return ""
+	default:
+		return countryIsoCode(record)
+	}
+}
+
+// writeAggregate answers with the aggregation of ips by the given field
+func (server *GeoServer) writeAggregate(resp http.ResponseWriter, ips []string, by string) {
+	if !validAggregate(by) {
+		http.Error(resp, "Unsupported aggregate: "+by, http.StatusBadRequest)
+		return
+	}
+	jsonData, err := json.Marshal(server.aggregate(ips, by))
+	if err != nil {
+		log.Errorf("Unable to encode aggregate: %v", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(jsonData)
+}
@@ -0,0 +1,242 @@
+package geoserve
+
+import (
+	"math"
+)
+
+// airport is a major airport, identified by its IATA code
+type airport struct {
+	iata      string
+	latitude  float64
+	longitude float64
+}
+
+// nearestAirport is the response field for ?include=airport
+type nearestAirport struct {
+	IATA       string  `json:"iata"`
+	DistanceKm float64 `json:"distance_km"`
+}
+
+// airports is a table of major airports around the world
+var airports = []airport{
+	// North America
+	{"ATL", 33.6407, -84.4277},
+	{"AUS", 30.1975, -97.6664},
+	{"BOS", 42.3656, -71.0096},
+	{"BWI", 39.1774, -76.6684},
+	{"CLT", 35.2144, -80.9473},
+	{"DEN", 39.8561, -104.6737},
+	{"DFW", 32.8998, -97.0403},
+	{"DTW", 42.2162, -83.3554},
+	{"EWR", 40.6895, -74.1745},
+	{"HNL", 21.3187, -157.9225},
+	{"IAD", 38.9531, -77.4565},
+	{"IAH", 29.9902, -95.3368},
+	{"JFK", 40.6413, -73.7781},
+	{"LAS", 36.0840, -115.1537},
+	{"LAX", 33.9416, -118.4085},
+	{"MCO", 28.4312, -81.3081},
+	{"MIA", 25.7959, -80.2870},
+	{"MSP", 44.8848, -93.2223},
+	{"ORD", 41.9742, -87.9073},
+	{"PDX", 45.5898, -122.5951},
+	{"PHL", 39.8744, -75.2424},
+	{"PHX", 33.4352, -112.0101},
+	{"SAN", 32.7338, -117.1933},
+	{"SEA", 47.4502, -122.3088},
+	{"SFO", 37.6213, -122.3790},
+	{"SLC", 40.7899, -111.9791},
+	{"STL", 38.7487, -90.3700},
+	{"ANC", 61.1743, -149.9962},
+	{"YUL", 45.4706, -73.7408},
+	{"YVR", 49.1967, -123.1815},
+	{"YYC", 51.1215, -114.0076},
+	{"YYZ", 43.6777, -79.6248},
+	{"MEX", 19.4361, -99.0719},
+	{"CUN", 21.0365, -86.8771},
+	{"GDL", 20.5218, -103.3112},
+	{"MTY", 25.7785, -100.1069},
+	// Central America and Caribbean
+	{"PTY", 9.0714, -79.3835},
+	{"SJO", 9.9939, -84.2088},
+	{"SJU", 18.4394, -66.0018},
+	{"HAV", 22.9892, -82.4091},
+	{"SDQ", 18.4297, -69.6689},
+	// South America
+	{"BOG", 4.7016, -74.1469},
+	{"EZE", -34.8222, -58.5358},
+	{"GIG", -22.8090, -43.2506},
+	{"GRU", -23.4356, -46.4731},
+	{"BSB", -15.8711, -47.9186},
+	{"LIM", -12.0219, -77.1143},
+	{"SCL", -33.3930, -70.7858},
+	{"UIO", -0.1292, -78.3575},
+	{"CCS", 10.6031, -66.9906},
+	{"MVD", -34.8384, -56.0308},
+	{"ASU", -25.2400, -57.5192},
+	{"VVI", -17.6448, -63.1354},
+	// Europe
+	{"AMS", 52.3105, 4.7683},
+	{"ARN", 59.6498, 17.9238},
+	{"ATH", 37.9364, 23.9445},
+	{"BCN", 41.2974, 2.0833},
+	{"BER", 52.3667, 13.5033},
+	{"BRU", 50.9010, 4.4856},
+	{"BUD", 47.4369, 19.2556},
+	{"CDG", 49.0097, 2.5479},
+	{"CPH", 55.6180, 12.6508},
+	{"DUB", 53.4264, -6.2499},
+	{"EDI", 55.9508, -3.3615},
+	{"FCO", 41.8003, 12.2389},
+	{"FRA", 50.0379, 8.5622},
+	{"HEL", 60.3172, 24.9633},
+	{"IST", 41.2753, 28.7519},
+	{"KBP", 50.3450, 30.8947},
+	{"LHR", 51.4700, -0.4543},
+	{"LGW", 51.1537, -0.1821},
+	{"LIS", 38.7742, -9.1342},
+	{"MAD", 40.4983, -3.5676},
+	{"MAN", 53.3588, -2.2727},
+	{"MUC", 48.3538, 11.7861},
+	{"MXP", 45.6306, 8.7281},
+	{"OSL", 60.1976, 11.1004},
+	{"OTP", 44.5711, 26.0850},
+	{"PRG", 50.1008, 14.2600},
+	{"SOF", 42.6967, 23.4114},
+	{"SVO", 55.9726, 37.4146},
+	{"LED", 59.8003, 30.2625},
+	{"VIE", 48.1103, 16.5697},
+	{"WAW", 52.1657, 20.9671},
+	{"ZRH", 47.4582, 8.5555},
+	{"KEF", 63.9850, -22.6056},
+	{"BEG", 44.8184, 20.3091},
+	{"RIX", 56.9236, 23.9711},
+	// Middle East
+	{"AUH", 24.4330, 54.6511},
+	{"DOH", 25.2731, 51.6081},
+	{"DXB", 25.2532, 55.3657},
+	{"IKA", 35.4161, 51.1522},
+	{"JED", 21.6796, 39.1565},
+	{"RUH", 24.9576, 46.6988},
+	{"TLV", 32.0055, 34.8854},
+	{"AMM", 31.7226, 35.9932},
+	{"BEY", 33.8209, 35.4884},
+	{"KWI", 29.2266, 47.9689},
+	{"BGW", 33.2625, 44.2346},
+	{"MCT", 23.5933, 58.2844},
+	// Africa
+	{"ADD", 8.9779, 38.7993},
+	{"ALG", 36.6910, 3.2154},
+	{"CAI", 30.1219, 31.4056},
+	{"CMN", 33.3675, -7.5898},
+	{"CPT", -33.9715, 18.6021},
+	{"DAR", -6.8781, 39.2026},
+	{"DKR", 14.6700, -17.0733},
+	{"JNB", -26.1392, 28.2460},
+	{"LOS", 6.5774, 3.3212},
+	{"ABV", 9.0068, 7.2632},
+	{"ACC", 5.6052, -0.1668},
+	{"NBO", -1.3192, 36.9278},
+	{"TUN", 36.8510, 10.2272},
+	{"KRT", 15.5895, 32.5532},
+	{"LAD", -8.8584, 13.2312},
+	{"FIH", -4.3858, 15.4446},
+	{"EBB", 0.0424, 32.4435},
+	{"KGL", -1.9686, 30.1395},
+	{"TNR", -18.7969, 47.4788},
+	{"MRU", -20.4302, 57.6836},
+	{"HRE", -17.9318, 31.0928},
+	{"LUN", -15.3308, 28.4526},
+	{"ABJ", 5.2614, -3.9263},
+	// Asia
+	{"BKK", 13.6900, 100.7501},
+	{"BOM", 19.0896, 72.8656},
+	{"CAN", 23.3924, 113.2988},
+	{"CGK", -6.1256, 106.6559},
+	{"CMB", 7.1808, 79.8841},
+	{"CTU", 30.5785, 103.9471},
+	{"DAC", 23.8433, 90.3978},
+	{"DEL", 28.5562, 77.1000},
+	{"BLR", 13.1986, 77.7066},
+	{"MAA", 12.9941, 80.1709},
+	{"CCU", 22.6547, 88.4467},
+	{"HYD", 17.2403, 78.4294},
+	{"HAN", 21.2212, 105.8072},
+	{"SGN", 10.8188, 106.6520},
+	{"HKG", 22.3080, 113.9185},
+	{"ICN", 37.4602, 126.4407},
+	{"GMP", 37.5583, 126.7906},
+	{"PUS", 35.1795, 128.9382},
+	{"KHI", 24.9065, 67.1608},
+	{"LHE", 31.5216, 74.4036},
+	{"ISB", 33.5491, 72.8256},
+	{"KIX", 34.4320, 135.2304},
+	{"KUL", 2.7456, 101.7072},
+	{"MNL", 14.5086, 121.0194},
+	{"CEB", 10.3075, 123.9790},
+	{"NRT", 35.7720, 140.3929},
+	{"HND", 35.5494, 139.7798},
+	{"CTS", 42.7752, 141.6923},
+	{"FUK", 33.5859, 130.4500},
+	{"PEK", 40.0799, 116.6031},
+	{"PKX", 39.5098, 116.4105},
+	{"PVG", 31.1443, 121.8083},
+	{"SHA", 31.1979, 121.3363},
+	{"SZX", 22.6393, 113.8107},
+	{"XIY", 34.4471, 108.7516},
+	{"KMG", 25.1019, 102.9292},
+	{"URC", 43.9071, 87.4742},
+	{"HRB", 45.6234, 126.2503},
+	{"SIN", 1.3644, 103.9915},
+	{"TPE", 25.0797, 121.2342},
+	{"KTM", 27.6966, 85.3591},
+	{"RGN", 16.9073, 96.1332},
+	{"PNH", 11.5466, 104.8441},
+	{"VTE", 17.9883, 102.5633},
+	{"ULN", 47.6469, 106.8192},
+	{"ALA", 43.3521, 77.0405},
+	{"NQZ", 51.0222, 71.4669},
+	{"TAS", 41.2579, 69.2812},
+	{"GYD", 40.4675, 50.0467},
+	{"TBS", 41.6692, 44.9547},
+	{"EVN", 40.1473, 44.3959},
+	{"KBL", 34.5659, 69.2123},
+	{"VVO", 43.3990, 132.1480},
+	{"OVB", 55.0126, 82.6507},
+	{"SVX", 56.7431, 60.8027},
+	{"KJA", 56.1729, 92.4933},
+	{"IKT", 52.2680, 104.3889},
+	{"YKS", 62.0933, 129.7706},
+	{"PKC", 53.1679, 158.4536},
+	// Oceania
+	{"AKL", -37.0082, 174.7850},
+	{"CHC", -43.4894, 172.5322},
+	{"WLG", -41.3272, 174.8053},
+	{"BNE", -27.3842, 153.1175},
+	{"MEL", -37.6690, 144.8410},
+	{"PER", -31.9385, 115.9672},
+	{"ADL", -34.9450, 138.5306},
+	{"DRW", -12.4147, 130.8769},
+	{"CNS", -16.8858, 145.7553},
+	{"SYD", -33.9399, 151.1753},
+	{"NAN", -17.7554, 177.4431},
+	{"POM", -9.4434, 147.2200},
+	{"NOU", -22.0146, 166.2130},
+	{"PPT", -17.5537, -149.6071},
+	{"APW", -13.8300, -172.0083},
+	{"GUM", 13.4834, 144.7960},
+}
+
+// nearestAirportTo finds the airport in the table closest to the given
+// coordinates
+func nearestAirportTo(latitude, longitude float64) *nearestAirport {
+	var nearest *nearestAirport
+	for _, a := range airports {
+		distance := haversineKm(latitude, longitude, a.latitude, a.longitude)
+		if nearest == nil || distance < nearest.DistanceKm {
+			nearest = &nearestAirport{a.iata, distance}
+		}
+	}
+	nearest.DistanceKm = math.Round(nearest.DistanceKm*10) / 10
+	return nearest
+}
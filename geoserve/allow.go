@@ -0,0 +1,39 @@
+package geoserve
+
+import (
+	"net"
+	"net/http"
+
+	errors "github.com/getlantern/errors"
+)
+
+// parseCIDRs parses the given CIDR ranges
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.New("invalid CIDR %v: %v", cidr, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// clientAllowed determines whether the client making req may query the
+// server. All clients are allowed unless allowed client ranges are configured.
+func (server *GeoServer) clientAllowed(req *http.Request) bool {
+	if server.allowedClientNets == nil {
+		return true
+	}
+	ip := net.ParseIP(server.ClientIP(req))
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range server.allowedClientNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
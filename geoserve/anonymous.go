@@ -0,0 +1,90 @@
+package geoserve
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+
+	errors "github.com/getlantern/errors"
+)
+
+// anonymousDBType is the type of the database used to detect anonymizers
+const anonymousDBType = "GeoIP2-Anonymous-IP"
+
+// anonymity tells whether an ip belongs to an anonymizer, according to the
+// GeoIP2-Anonymous-IP database
+type anonymity struct {
+	IP                string `json:"ip"`
+	IsAnonymous       bool   `json:"is_anonymous"`
+	IsAnonymousVPN    bool   `json:"is_anonymous_vpn"`
+	IsHostingProvider bool   `json:"is_hosting_provider"`
+	IsPublicProxy     bool   `json:"is_public_proxy"`
+	IsTorExitNode     bool   `json:"is_tor_exit_node"`
+}
+
+// lookupAnonymity looks up whether ip belongs to an anonymizer. It returns a
+// nil anonymity if no anonymous ip database is loaded.
+func (server *GeoServer) lookupAnonymity(ip net.IP) (*anonymity, error) {
+	aux := server.auxiliaryDbs[anonymousDBType]
+	if aux == nil {
+		return nil, nil
+	}
+	aux.mx.RLock()
+	defer aux.mx.RUnlock()
+	if aux.db == nil {
+		return nil, nil
+	}
+	record, err := aux.db.AnonymousIP(ip)
+	if err != nil {
+		return nil, errors.New("unable to look up anonymity of %v: %v", ip, err)
+	}
+	return &anonymity{
+		IP:                ip.String(),
+		IsAnonymous:       record.IsAnonymous,
+		IsAnonymousVPN:    record.IsAnonymousVPN,
+		IsHostingProvider: record.IsHostingProvider,
+		IsPublicProxy:     record.IsPublicProxy,
+		IsTorExitNode:     record.IsTorExitNode,
+	}, nil
+}
+
+// HandleAnonymous answers whether the ip following basePath, or the client's
+// ip if there is none, is an anonymous VPN, hosting provider, public proxy or
+// Tor exit node, e.g. /anonymous/66.69.242.177 returns
+// {"ip":"66.69.242.177","is_anonymous":true,"is_anonymous_vpn":true,"is_hosting_provider":false,...}.
+// Every flag is always present. It answers 503 if no GeoIP2-Anonymous-IP
+// database is configured, see WithAnonymousDB.
+func (server *GeoServer) HandleAnonymous(resp http.ResponseWriter, req *http.Request, basePath string) {
+	if !server.clientAllowed(req) {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+	ipString := strings.Trim(strings.TrimPrefix(req.URL.Path, basePath), "/")
+	if ipString == "" {
+		ipString = server.ClientIP(req)
+	}
+	ip := net.ParseIP(ipString)
+	if ip == nil {
+		writeJSONError(resp, http.StatusBadRequest, "invalid ip address "+ipString)
+		return
+	}
+	a, err := server.lookupAnonymity(ip)
+	if err != nil {
+		log.Error(err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if a == nil {
+		writeJSONError(resp, http.StatusServiceUnavailable, "no anonymous ip database loaded")
+		return
+	}
+	jsonData, err := json.Marshal(a)
+	if err != nil {
+		log.Errorf("Unable to encode anonymity: %v", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(jsonData)
+}
@@ -0,0 +1,127 @@
+package geoserve
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+
+	"github.com/mholt/archiver/v3"
+
+	errors "github.com/getlantern/errors"
+)
+
+// Archive formats in which a database can be downloaded
+const (
+	formatTarGz  = "tar.gz"
+	formatTar    = "tar"
+	formatMmdbGz = "mmdb.gz"
+	formatMmdb   = "mmdb"
+	formatZip    = "zip"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zipMagic  = []byte("PK\x03\x04")
+	// tarMagic is found at tarMagicOffset in the first header of a tar file
+	tarMagic       = []byte("ustar")
+	tarMagicOffset = 257
+	// mmdbMetadataMarker precedes the metadata at the end of every mmdb file
+	mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+)
+
+// defaultDbFileNames are the names of the database files looked for in
+// archives unless a database type is configured
+var defaultDbFileNames = map[string]bool{
+	"GeoLite2-Country.mmdb": true,
+	"GeoLite2-City.mmdb":    true,
+}
+
+// extractDb extracts the raw mmdb file from body, which may be a tar.gz or tar
+// archive containing it, a gzipped mmdb file or a plain mmdb file. The format
+// is detected from the content itself; contentType is only used to describe
+// unexpected formats. Archives must contain a <dbType>.mmdb file, or if dbType
+// is "", one of the defaultDbFileNames.
+func extractDb(body io.Reader, contentType string, dbType string) ([]byte, error) {
+	format, r, err := detectArchiveFormat(body)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("Extracting database from %v (Content-Type %v)", format, contentType)
+	switch format {
+	case formatTarGz, formatTar:
+		dbFileNames := defaultDbFileNames
+		if dbType != "" {
+			dbFileNames = map[string]bool{dbType + ".mmdb": true}
+		}
+		return extractDbFromTar(r, dbFileNames)
+	case formatMmdbGz, formatMmdb:
+		dbData, err := io.ReadAll(r)
+		if err != nil {
+			return nil, errors.New("unable to read %v: %v", format, err)
+		}
+		if !bytes.Contains(dbData, mmdbMetadataMarker) {
+			return nil, errors.New("unexpected database format, not a tar.gz, tar, mmdb.gz or mmdb file (Content-Type %v)", contentType)
+		}
+		return dbData, nil
+	default:
+		return nil, errors.New("unexpected database format %v (Content-Type %v)", format, contentType)
+	}
+}
+
+// detectArchiveFormat determines the format of body from its magic bytes,
+// returning a reader of the contents with any gzip compression removed
+func detectArchiveFormat(body io.Reader) (string, io.Reader, error) {
+	buffered := bufio.NewReader(body)
+	head, _ := buffered.Peek(len(zipMagic))
+	switch {
+	case bytes.HasPrefix(head, zipMagic):
+		return formatZip, buffered, nil
+	case bytes.HasPrefix(head, gzipMagic):
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return "", nil, errors.New("unable to read gzip: %v", err)
+		}
+		contents := bufio.NewReader(gz)
+		if isTar(contents) {
+			return formatTarGz, contents, nil
+		}
+		return formatMmdbGz, contents, nil
+	case isTar(buffered):
+		return formatTar, buffered, nil
+	default:
+		return formatMmdb, buffered, nil
+	}
+}
+
+// isTar determines whether r starts with a tar header, without consuming it
+func isTar(r *bufio.Reader) bool {
+	head, _ := r.Peek(tarMagicOffset + len(tarMagic))
+	return len(head) == tarMagicOffset+len(tarMagic) && bytes.Equal(head[tarMagicOffset:], tarMagic)
+}
+
+// extractDbFromTar reads the first of the dbFileNames in the tar archive r
+func extractDbFromTar(r io.Reader, dbFileNames map[string]bool) ([]byte, error) {
+	untarrer := archiver.NewTar()
+	err := untarrer.Open(r, 0)
+	if err != nil {
+		return nil, errors.New("unable to open tar: %v", err)
+	}
+	defer untarrer.Close()
+	for {
+		f, err := untarrer.Read()
+		if err == io.EOF {
+			return nil, errors.New("no database file in archive")
+		}
+		if err != nil {
+			return nil, errors.New("unable to read from tar: %v", err)
+		}
+		if dbFileNames[f.Name()] {
+			dbData, err := io.ReadAll(f)
+			if err != nil {
+				return nil, errors.New("unable to read %v: %v", f.Name(), err)
+			}
+			return dbData, nil
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package geoserve
+
+import (
+	"runtime"
+	"time"
+)
+
+// minAutoTuneLookups is the number of lookups a cache needs to have seen in an
+// interval for its hit rate to be meaningful enough to tune by
+const minAutoTuneLookups = 100
+
+// CacheAutoTune configures the automatic sizing of the caches. Every Interval,
+// each cache whose hit rate was below TargetHitRate is doubled in size, up to
+// MaxSize, while the heap is below MaxMemoryBytes. Once the heap exceeds
+// MaxMemoryBytes, all caches are instead halved in size, down to MinSize,
+// evicting entries as the cache policy dictates so that the most valuable
+// entries are kept.
+type CacheAutoTune struct {
+	Interval       time.Duration
+	MinSize        int
+	MaxSize        int
+	TargetHitRate  float64
+	MaxMemoryBytes uint64
+}
+
+// lookupCounts counts the cache hits and misses of a cache mode
+type lookupCounts struct {
+	hits   int
+	misses int
+}
+
+// countLookup records whether lookup g was answered from the cache. It must be
+// called with cacheMx held.
+func (server *GeoServer) countLookup(g get, hit bool) {
+	if server.autoTune == nil {
+		return
+	}
+	mode := server.cacheModeFor(g)
+	counts := server.lookupCounts[mode]
+	if counts == nil {
+		counts = &lookupCounts{}
+		server.lookupCounts[mode] = counts
+	}
+	if hit {
+		counts.hits++
+	} else {
+		counts.misses++
+	}
+}
+
+// tuneCaches resizes the caches based on their hit rates and the memory in
+// use over the last interval.
+func (server *GeoServer) tuneCaches() {
+	server.cacheMx.Lock()
+	defer server.cacheMx.Unlock()
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	overMemory := memStats.HeapAlloc > server.autoTune.MaxMemoryBytes
+	for mode, c := range server.caches {
+		size, found := server.cacheSizes[mode]
+		if !found {
+			size = server.defaultCacheSize
+		}
+		if size <= 0 {
+			// caching is disabled for this mode
+			continue
+		}
+		newSize := size
+		counts := server.lookupCounts[mode]
+		if overMemory {
+			newSize = size / 2
+			if newSize < server.autoTune.MinSize {
+				newSize = server.autoTune.MinSize
+			}
+		} else if counts != nil && counts.hits+counts.misses >= minAutoTuneLookups {
+			hitRate := float64(counts.hits) / float64(counts.hits+counts.misses)
+			if hitRate < server.autoTune.TargetHitRate {
+				newSize = size * 2
+				if newSize > server.autoTune.MaxSize {
+					newSize = server.autoTune.MaxSize
+				}
+			}
+		}
+		if newSize != size {
+			log.Debugf("Resizing %v cache from %d to %d entries (heap %d bytes)", mode, size, newSize, memStats.HeapAlloc)
+			c.resize(newSize)
+			server.cacheSizes[mode] = newSize
+		}
+	}
+	server.lookupCounts = make(map[string]*lookupCounts)
+}
@@ -0,0 +1,114 @@
+package geoserve
+
+import (
+	"sync"
+	"time"
+
+	errors "github.com/getlantern/errors"
+)
+
+// auxiliaryDb is a database used alongside the main one for particular
+// lookups, like the GeoIP2-Anonymous-IP database for HandleAnonymous. It's read
+// from a file or downloaded from a URL and kept current on its own goroutine.
+type auxiliaryDb struct {
+	dbType string
+	file   string
+	url    string
+
+	// mx guards db
+	mx sync.RWMutex
+	db *database
+}
+
+// auxiliaryDbFor returns the auxiliary database of dbType, creating it if
+// necessary
+func (server *GeoServer) auxiliaryDbFor(dbType string) *auxiliaryDb {
+	if server.auxiliaryDbs == nil {
+		server.auxiliaryDbs = make(map[string]*auxiliaryDb)
+	}
+	aux := server.auxiliaryDbs[dbType]
+	if aux == nil {
+		aux = &auxiliaryDb{dbType: dbType}
+		server.auxiliaryDbs[dbType] = aux
+	}
+	return aux
+}
+
+// loadAuxiliaryDbs reads the auxiliary databases configured with a file,
+// checking that they're of the right type
+func (server *GeoServer) loadAuxiliaryDbs() error {
+	for _, aux := range server.auxiliaryDbs {
+		if aux.file == "" {
+			continue
+		}
+		db, _, err := server.readDbFromFile(aux.file)
+		if err != nil {
+			return err
+		}
+		if dbType := db.mmdb.Metadata.DatabaseType; dbType != aux.dbType {
+			db.Close()
+			return errors.New("%v is a %v database, expected %v", aux.file, dbType, aux.dbType)
+		}
+		aux.db = db
+	}
+	return nil
+}
+
+// keepAuxiliaryDbsCurrent starts keeping each of the auxiliary databases
+// configured with a URL current
+func (server *GeoServer) keepAuxiliaryDbsCurrent() {
+	for _, aux := range server.auxiliaryDbs {
+		if aux.url != "" {
+			aux := aux
+			go server.runForever("keepDbCurrent "+aux.dbType, func() { server.keepAuxiliaryDbCurrent(aux) })
+		}
+	}
+}
+
+// keepAuxiliaryDbCurrent keeps aux up to date with the database at its URL,
+// checking as often as keepDbCurrent does for the main database, until the
+// server is closed
+func (server *GeoServer) keepAuxiliaryDbCurrent(aux *auxiliaryDb) {
+	// Restarted after a panic, this picks up the version downloaded so far
+	var lastModified time.Time
+	var etag string
+	aux.mx.RLock()
+	if aux.db != nil {
+		lastModified, etag = aux.db.lastModified, aux.db.etag
+	}
+	aux.mx.RUnlock()
+	server.keepCurrent(aux.url, aux.dbType, lastModified, etag, func(db *database) error {
+		return server.setAuxiliaryDb(aux, db)
+	}, nil, nil)
+}
+
+// setAuxiliaryDb replaces the database of aux with db, closing the old one. If
+// the server has been closed, db is closed instead.
+func (server *GeoServer) setAuxiliaryDb(aux *auxiliaryDb, db *database) error {
+	aux.mx.Lock()
+	defer aux.mx.Unlock()
+	select {
+	case <-server.done:
+		db.Close()
+		return errClosed
+	default:
+	}
+	if aux.db != nil {
+		aux.db.Close()
+	}
+	aux.db = db
+	log.Debugf("Loaded %v database last modified at %v", aux.dbType, db.lastModified)
+	return nil
+}
+
+// closeAuxiliaryDbs closes the auxiliary databases
+func (server *GeoServer) closeAuxiliaryDbs() {
+	for _, aux := range server.auxiliaryDbs {
+		aux.mx.Lock()
+		if aux.db != nil {
+			aux.db.Close()
+			aux.db = nil
+		}
+		aux.mx.Unlock()
+	}
+}
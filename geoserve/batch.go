@@ -0,0 +1,99 @@
+package geoserve
+
+import (
+	"encoding/json"
+	gerrors "errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// MaxBatchSize is the maximum number of ips in a batch lookup
+	MaxBatchSize = 1000
+
+	maxBatchBodySize = 1 << 20
+)
+
+// HandleBatch geolocates the JSON array of ips POSTed to it, answering with a
+// JSON object keyed by ip. Invalid ips map to {"error":...} and ips that can't
+// be looked up map to null. Batches of more than MaxBatchSize ips or 1 MiB are
+// rejected with 413. With ?aggregate=country, region or continent, it instead
+// answers with the number of ips per country, region or continent. A batch
+// counts as one lookup towards load shedding and WithMaxInFlight.
+func (server *GeoServer) HandleBatch(resp http.ResponseWriter, req *http.Request, allowOrigin string) {
+	setAllowOrigin(resp, req, allowOrigin)
+	if answerPreflight(resp, req) {
+		return
+	}
+	if !server.clientAllowed(req) {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if req.Method != http.MethodPost {
+		resp.Header().Set("Allow", http.MethodPost)
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(resp, req.Body, maxBatchBodySize))
+	var tooLarge *http.MaxBytesError
+	if gerrors.As(err, &tooLarge) {
+		http.Error(resp, "Batches are limited to "+strconv.Itoa(maxBatchBodySize)+" bytes", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(resp, "Unable to read batch", http.StatusBadRequest)
+		return
+	}
+	var ips []string
+	err = json.Unmarshal(data, &ips)
+	if err != nil {
+		http.Error(resp, "Batch must be a JSON array of ips", http.StatusBadRequest)
+		return
+	}
+	if len(ips) > MaxBatchSize {
+		http.Error(resp, "Batches are limited to "+strconv.Itoa(MaxBatchSize)+" ips", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if server.shouldShed() {
+		writeShed(resp)
+		return
+	}
+	if !server.startLookup() {
+		writeOverloaded(resp)
+		return
+	}
+	defer server.finishLookup()
+	if by := req.URL.Query().Get("aggregate"); by != "" {
+		server.writeAggregate(resp, ips, by)
+		return
+	}
+
+	invalid, err := json.Marshal(&errorResponse{"invalid ip address"})
+	if err != nil {
+		log.Errorf("Unable to encode batch error: %v", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	results := make(map[string]json.RawMessage, len(ips))
+	for _, ip := range ips {
+		if net.ParseIP(ip) == nil {
+			results[ip] = invalid
+			continue
+		}
+		results[ip] = nil
+		gr := server.query(get{ip: ip})
+		if gr.res != nil {
+			results[ip] = gr.res.jsonData
+		}
+	}
+	jsonData, err := json.Marshal(results)
+	if err != nil {
+		log.Errorf("Unable to encode batch results: %v", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(jsonData)
+}
@@ -0,0 +1,45 @@
+package geoserve
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func postBatch(server *GeoServer, body string) *httptest.ResponseRecorder {
+	resp := httptest.NewRecorder()
+	server.HandleBatch(resp, httptest.NewRequest(http.MethodPost, "/lookup/batch", strings.NewReader(body)), "")
+	return resp
+}
+
+func TestBatchInvalidIPs(t *testing.T) {
+	server := newTestServer(t)
+	resp := postBatch(server, `["`+testIP+`","favicon.ico"]`)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var results map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &results))
+	assert.Contains(t, string(results[testIP]), "Berlin")
+	assert.JSONEq(t, `{"error":"invalid ip address"}`, string(results["favicon.ico"]))
+}
+
+func TestBatchTooLarge(t *testing.T) {
+	server := newTestServer(t)
+	resp := postBatch(server, `["`+strings.Repeat("1", maxBatchBodySize)+`"]`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.Code)
+}
+
+func TestBatchCountsAsInFlight(t *testing.T) {
+	server := newTestServer(t, WithMaxInFlight(1))
+	require.True(t, server.startLookup())
+	resp := postBatch(server, `["`+testIP+`"]`)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+	server.finishLookup()
+	resp = postBatch(server, `["`+testIP+`"]`)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.EqualValues(t, 0, server.inFlight.Load())
+}
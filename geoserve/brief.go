@@ -0,0 +1,74 @@
+package geoserve
+
+import (
+	"encoding/json"
+
+	geoip2 "github.com/oschwald/geoip2-golang"
+
+	errors "github.com/getlantern/errors"
+)
+
+// ModeBrief is the value of the mode query parameter that returns only the
+// country, region and city
+const ModeBrief = "brief"
+
+// brief is the minimal geolocation returned for ?mode=brief. Levels that
+// aren't known are empty.
+type brief struct {
+	Country string `json:"country"`
+	Region  string `json:"region"`
+	City    string `json:"city"`
+}
+
+// briefOf summarizes a *geoip2.City, *geoip2.Enterprise or *geoip2.Country
+// record, using the ISO codes of the country and region and the English name of
+// the city
+func briefOf(record interface{}) *brief {
+	b := &brief{}
+	switch r := record.(type) {
+	case *geoip2.City:
+		b.Country = r.Country.IsoCode
+		if len(r.Subdivisions) > 0 {
+			b.Region = r.Subdivisions[0].IsoCode
+		}
+		b.City = r.City.Names["en"]
+	case *geoip2.Enterprise:
+		b.Country = r.Country.IsoCode
+		if len(r.Subdivisions) > 0 {
+			b.Region = r.Subdivisions[0].IsoCode
+		}
+		b.City = r.City.Names["en"]
+	case *geoip2.Country:
+		b.Country = r.Country.IsoCode
+	case *brief:
+		return r
+	}
+	return b
+}
+
+// regionOf returns the ISO code and English name of the first subdivision
+// (e.g. state or province) of a *geoip2.City or *geoip2.Enterprise record,
+// both "" if it has none
+func regionOf(record interface{}) (isoCode string, name string) {
+	switch r := record.(type) {
+	case *geoip2.City:
+		if len(r.Subdivisions) > 0 {
+			return r.Subdivisions[0].IsoCode, r.Subdivisions[0].Names["en"]
+		}
+	case *geoip2.Enterprise:
+		if len(r.Subdivisions) > 0 {
+			return r.Subdivisions[0].IsoCode, r.Subdivisions[0].Names["en"]
+		}
+	}
+	return "", ""
+}
+
+// toBrief converts the full result res into a brief one
+func toBrief(res *result) (*result, error) {
+	b := briefOf(res.record)
+	jsonData, err := json.Marshal(b)
+	if err != nil {
+		return nil, errors.New("Unable to encode brief json response: %v", err)
+	}
+	return &result{record: b, jsonData: jsonData, source: res.source, stale: res.stale, fresh: res.fresh, empty: res.empty}, nil
+}
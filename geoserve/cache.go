@@ -0,0 +1,298 @@
+package geoserve
+
+import (
+	"container/list"
+	"time"
+
+	"github.com/golang/groupcache/lru"
+)
+
+// Cache eviction policies
+const (
+	CachePolicyLRU = "lru"
+	CachePolicyLFU = "lfu"
+)
+
+// Cache modes. Each kind of lookup result is cached separately so that the
+// capacity of each cache can be sized for the size of its results.
+const (
+	CacheModeCity     = "city"
+	CacheModeCountry  = "country"
+	CacheModeRaw      = "raw"
+	CacheModeBrief    = "brief"
+	CacheModeTimezone = "timezone"
+)
+
+var cacheModes = []string{CacheModeCity, CacheModeCountry, CacheModeRaw, CacheModeBrief, CacheModeTimezone}
+
+// newCaches constructs an empty cache for each mode, using the size configured
+// for that mode or the default size if none was configured
+func (server *GeoServer) newCaches() map[string]cache {
+	caches := make(map[string]cache, len(cacheModes))
+	for _, mode := range cacheModes {
+		size, found := server.cacheSizes[mode]
+		if !found {
+			size = server.defaultCacheSize
+		}
+		caches[mode] = newCache(server.cachePolicy, size)
+	}
+	return caches
+}
+
+// cacheFor returns the cache for the mode of lookup g
+func (server *GeoServer) cacheFor(g get) cache {
+	return server.caches[server.cacheModeFor(g)]
+}
+
+// cachedEntry is a result in the cache along with when it was added
+type cachedEntry struct {
+	res   *result
+	added time.Time
+}
+
+// cachedResult gets the cached result of lookup g under cacheKey, treating
+// results older than the cache TTL, or the negative cache TTL for ips that the
+// database has no data for, as missing. It must be called with cacheMx held.
+func (server *GeoServer) cachedResult(g get, cacheKey string) (*result, bool) {
+	cached, found := server.cacheFor(g).Get(cacheKey)
+	if !found {
+		return nil, false
+	}
+	entry := cached.(*cachedEntry)
+	ttl := server.cacheTTL
+	if entry.res.empty && server.negativeCacheTTL > 0 {
+		ttl = server.negativeCacheTTL
+	}
+	if ttl > 0 && server.clock.Now().Sub(entry.added) > ttl {
+		return nil, false
+	}
+	return entry.res, true
+}
+
+// cacheResult caches res as the result of lookup g under cacheKey. It must be
+// called with cacheMx held.
+func (server *GeoServer) cacheResult(g get, cacheKey string, res *result) {
+	server.cacheFor(g).Add(cacheKey, &cachedEntry{res, server.clock.Now()})
+}
+
+// cacheModeFor returns the cache mode of lookup g
+func (server *GeoServer) cacheModeFor(g get) string {
+	switch {
+	case g.raw:
+		return CacheModeRaw
+	case g.brief:
+		return CacheModeBrief
+	case g.timezone:
+		return CacheModeTimezone
+	case g.country:
+		return CacheModeCountry
+	default:
+		return CacheModeCity
+	}
+}
+
+// cache is a bounded cache of lookup results
+type cache interface {
+	Get(key string) (value interface{}, ok bool)
+	Add(key string, value interface{})
+	Len() int
+	// resize changes the capacity of the cache, evicting entries as the
+	// eviction policy dictates if it shrinks
+	resize(size int)
+	// takeChurn returns the number of entries added and evicted since the
+	// last call
+	takeChurn() (added int, evicted int)
+}
+
+// churnCounts counts the entries added to and evicted from a cache
+type churnCounts struct {
+	added   int
+	evicted int
+}
+
+func (c *churnCounts) takeChurn() (added int, evicted int) {
+	added, evicted = c.added, c.evicted
+	c.added, c.evicted = 0, 0
+	return
+}
+
+// newCache constructs a cache of the given size using the given eviction
+// policy. A size of 0 or less disables caching.
+func newCache(policy string, size int) cache {
+	if size <= 0 {
+		return noCache{}
+	}
+	if policy == CachePolicyLFU {
+		return newLFUCache(size)
+	}
+	c := &lruCache{cache: lru.New(size)}
+	c.cache.OnEvicted = func(lru.Key, interface{}) {
+		c.evicted++
+	}
+	return c
+}
+
+// noCache is a cache that never caches anything
+type noCache struct{}
+
+func (noCache) Get(key string) (interface{}, bool) {
+	return nil, false
+}
+
+func (noCache) Add(key string, value interface{}) {}
+
+func (noCache) Len() int {
+	return 0
+}
+
+func (noCache) resize(size int) {}
+
+func (noCache) takeChurn() (int, int) {
+	return 0, 0
+}
+
+// lruCache is a cache that evicts the least recently used entries
+type lruCache struct {
+	churnCounts
+	cache *lru.Cache
+}
+
+func (c *lruCache) Get(key string) (interface{}, bool) {
+	return c.cache.Get(key)
+}
+
+func (c *lruCache) Add(key string, value interface{}) {
+	if _, found := c.cache.Get(key); !found {
+		c.added++
+	}
+	c.cache.Add(key, value)
+}
+
+func (c *lruCache) Len() int {
+	return c.cache.Len()
+}
+
+func (c *lruCache) resize(size int) {
+	c.cache.MaxEntries = size
+	for c.cache.Len() > size {
+		c.cache.RemoveOldest()
+	}
+}
+
+// lfuCache is a cache that evicts the least frequently used entries, breaking
+// ties by evicting the least recently used. Get and Add are O(1), while
+// shrinking the cache with resize may scan the distinct use counts.
+type lfuCache struct {
+	churnCounts
+	size    int
+	entries map[string]*lfuEntry
+	// freqs holds the entries with each use count, most recently used first
+	freqs map[int]*list.List
+	// minFreq is the lowest use count of any entry, or 0 if it's unknown
+	minFreq int
+}
+
+type lfuEntry struct {
+	key   string
+	value interface{}
+	freq  int
+	elem  *list.Element
+}
+
+func newLFUCache(size int) *lfuCache {
+	return &lfuCache{
+		size:    size,
+		entries: make(map[string]*lfuEntry, size),
+		freqs:   make(map[int]*list.List),
+	}
+}
+
+func (c *lfuCache) Get(key string) (interface{}, bool) {
+	entry, found := c.entries[key]
+	if !found {
+		return nil, false
+	}
+	c.touch(entry)
+	return entry.value, true
+}
+
+func (c *lfuCache) Add(key string, value interface{}) {
+	if entry, found := c.entries[key]; found {
+		entry.value = value
+		c.touch(entry)
+		return
+	}
+	if len(c.entries) >= c.size {
+		c.evict()
+	}
+	c.added++
+	entry := &lfuEntry{key: key, value: value, freq: 1}
+	entry.elem = c.listFor(1).PushFront(entry)
+	c.entries[key] = entry
+	c.minFreq = 1
+}
+
+// touch moves entry up to the next use count
+func (c *lfuCache) touch(entry *lfuEntry) {
+	l := c.freqs[entry.freq]
+	l.Remove(entry.elem)
+	if l.Len() == 0 {
+		delete(c.freqs, entry.freq)
+		if c.minFreq == entry.freq {
+			c.minFreq++
+		}
+	}
+	entry.freq++
+	entry.elem = c.listFor(entry.freq).PushFront(entry)
+}
+
+// evict removes the least recently used of the least frequently used entries
+func (c *lfuCache) evict() {
+	if c.minFreq == 0 {
+		c.minFreq = c.lowestFreq()
+	}
+	l := c.freqs[c.minFreq]
+	if l == nil {
+		return
+	}
+	entry := l.Remove(l.Back()).(*lfuEntry)
+	if l.Len() == 0 {
+		delete(c.freqs, c.minFreq)
+		// Add resets minFreq, so only another eviction without an Add in
+		// between, as when resizing, has to look for the next lowest count
+		c.minFreq = 0
+	}
+	delete(c.entries, entry.key)
+	c.evicted++
+}
+
+// lowestFreq returns the lowest use count of any entry, or 0 if there are none
+func (c *lfuCache) lowestFreq() int {
+	lowest := 0
+	for freq := range c.freqs {
+		if lowest == 0 || freq < lowest {
+			lowest = freq
+		}
+	}
+	return lowest
+}
+
+func (c *lfuCache) Len() int {
+	return len(c.entries)
+}
+
+func (c *lfuCache) resize(size int) {
+	c.size = size
+	for len(c.entries) > size && len(c.entries) > 0 {
+		c.evict()
+	}
+}
+
+func (c *lfuCache) listFor(freq int) *list.List {
+	l := c.freqs[freq]
+	if l == nil {
+		l = list.New()
+		c.freqs[freq] = l
+	}
+	return l
+}
@@ -0,0 +1,105 @@
+package geoserve
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLFUResizeMixedFrequencies(t *testing.T) {
+	c := newLFUCache(10)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		c.Add(key, key)
+	}
+	// a is used 4 times, b 3 times, c twice and d once
+	for i := 0; i < 3; i++ {
+		c.Get("a")
+	}
+	for i := 0; i < 2; i++ {
+		c.Get("b")
+	}
+	c.Get("c")
+
+	// Evicting d empties the lowest frequency list, the next eviction has to
+	// find c's
+	resized := make(chan struct{})
+	go func() {
+		c.resize(2)
+		close(resized)
+	}()
+	select {
+	case <-resized:
+	case <-time.After(5 * time.Second):
+		t.Fatal("resize didn't return")
+	}
+
+	assert.Equal(t, 2, c.Len())
+	for _, key := range []string{"a", "b"} {
+		_, found := c.Get(key)
+		assert.True(t, found, "%v should have survived", key)
+	}
+	for _, key := range []string{"c", "d"} {
+		_, found := c.Get(key)
+		assert.False(t, found, "%v should have been evicted", key)
+	}
+	_, evicted := c.takeChurn()
+	assert.Equal(t, 2, evicted)
+
+	// Shrinking to nothing empties every list
+	c.resize(0)
+	require.Equal(t, 0, c.Len())
+	assert.Empty(t, c.freqs)
+}
+
+// BenchmarkCacheHitRate compares the hit rates of the eviction policies on a
+// workload where most lookups are for a skewed set of popular ips, interrupted
+// by bursts of lookups for ips that are popular only briefly, like a crawler
+// walking a range.
+func BenchmarkCacheHitRate(b *testing.B) {
+	const (
+		cacheSize  = 1000
+		popularIPs = 10000
+		burstEvery = 5000
+		burstIPs   = 2000
+		burstHits  = 3
+	)
+	for _, policy := range []string{CachePolicyLRU, CachePolicyLFU} {
+		b.Run(policy, func(b *testing.B) {
+			rnd := rand.New(rand.NewSource(1))
+			zipf := rand.NewZipf(rnd, 1.1, 1, popularIPs-1)
+			c := newCache(policy, cacheSize)
+			lookup := func(key string) bool {
+				if _, found := c.Get(key); found {
+					return true
+				}
+				c.Add(key, key)
+				return false
+			}
+
+			hits, lookups := 0, 0
+			burst := 0
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if i%burstEvery == 0 {
+					// Each ip in the burst is looked up a few times in a row
+					burst++
+					for j := 0; j < burstIPs*burstHits; j++ {
+						if lookup("burst/" + strconv.Itoa(burst) + "/" + strconv.Itoa(j/burstHits)) {
+							hits++
+						}
+						lookups++
+					}
+				}
+				if lookup(strconv.FormatUint(zipf.Uint64(), 10)) {
+					hits++
+				}
+				lookups++
+			}
+			b.ReportMetric(100*float64(hits)/float64(lookups), "hit%")
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package geoserve
+
+import (
+	"encoding/json"
+	"strings"
+	"unicode"
+
+	errors "github.com/getlantern/errors"
+)
+
+// Key casings, selected with the case query parameter. Without a casing, keys
+// are returned as they come from the record, which is PascalCase for geoip2
+// records and snake_case for raw ones.
+const (
+	CaseCamel  = "camel"
+	CaseSnake  = "snake"
+	CasePascal = "pascal"
+)
+
+func validCase(keyCase string) bool {
+	return keyCase == "" || keyCase == CaseCamel || keyCase == CaseSnake || keyCase == CasePascal
+}
+
+// recase re-keys the JSON object jsonData using keyCase. The keys of Names
+// maps are language codes and are left as they are.
+func recase(jsonData []byte, keyCase string) ([]byte, error) {
+	var decoded interface{}
+	err := json.Unmarshal(jsonData, &decoded)
+	if err != nil {
+		return nil, errors.New("unable to decode json for recasing: %v", err)
+	}
+	return json.Marshal(recaseIn(decoded, keyCase))
+}
+
+func recaseIn(value interface{}, keyCase string) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		recased := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			if key != "Names" && key != "names" {
+				child = recaseIn(child, keyCase)
+			}
+			recased[recaseKey(key, keyCase)] = child
+		}
+		return recased
+	case []interface{}:
+		for i, child := range v {
+			v[i] = recaseIn(child, keyCase)
+		}
+	}
+	return value
+}
+
+// recaseKey converts key, which may be in any of the casings, to keyCase
+func recaseKey(key string, keyCase string) string {
+	words := splitWords(key)
+	for i, word := range words {
+		switch {
+		case keyCase == CaseSnake:
+			words[i] = strings.ToLower(word)
+		case keyCase == CaseCamel && i == 0:
+			words[i] = strings.ToLower(word)
+		default:
+			words[i] = strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+	if keyCase == CaseSnake {
+		return strings.Join(words, "_")
+	}
+	return strings.Join(words, "")
+}
+
+// splitWords splits key into words at underscores and changes of case, keeping
+// acronyms together, so that GeoNameID, geoNameID and geo_name_id all become
+// Geo/geo, Name/name and ID/id.
+func splitWords(key string) []string {
+	var words []string
+	runes := []rune(key)
+	start := 0
+	for i := 0; i <= len(runes); i++ {
+		boundary := i == len(runes) || runes[i] == '_'
+		if !boundary && i > start && unicode.IsUpper(runes[i]) {
+			prevLower := unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1])
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			boundary = prevLower || (unicode.IsUpper(runes[i-1]) && nextLower)
+			if boundary {
+				words = append(words, string(runes[start:i]))
+				start = i
+			}
+			continue
+		}
+		if boundary {
+			if i > start {
+				words = append(words, string(runes[start:i]))
+			}
+			start = i + 1
+		}
+	}
+	return words
+}
@@ -0,0 +1,56 @@
+package geoserve
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// CacheChurn describes how many entries of a cache were added and evicted
+// during the last churn interval. When most entries are replaced every
+// interval, the cache is too small for the variety of ips being looked up.
+type CacheChurn struct {
+	Entries         int     `json:"entries"`
+	Added           int     `json:"added"`
+	Evicted         int     `json:"evicted"`
+	AddedFraction   float64 `json:"added_fraction"`
+	EvictedFraction float64 `json:"evicted_fraction"`
+}
+
+// recordChurn snapshots and logs the churn of each cache since the last
+// snapshot.
+func (server *GeoServer) recordChurn() {
+	server.cacheMx.Lock()
+	defer server.cacheMx.Unlock()
+	churn := make(map[string]CacheChurn, len(server.caches))
+	for mode, c := range server.caches {
+		cc := CacheChurn{Entries: c.Len()}
+		cc.Added, cc.Evicted = c.takeChurn()
+		if cc.Entries > 0 {
+			cc.AddedFraction = float64(cc.Added) / float64(cc.Entries)
+			cc.EvictedFraction = float64(cc.Evicted) / float64(cc.Entries)
+		}
+		churn[mode] = cc
+		log.Debugf("Cache churn for %v over %v: %d entries, %d added (%.2f), %d evicted (%.2f)",
+			mode, server.churnInterval, cc.Entries, cc.Added, cc.AddedFraction, cc.Evicted, cc.EvictedFraction)
+	}
+	server.churn.Store(&churn)
+}
+
+// CacheChurn returns the churn of each cache mode over the most recent churn
+// interval, or nil if none has been recorded yet.
+func (server *GeoServer) CacheChurn() map[string]CacheChurn {
+	churn := server.churn.Load()
+	if churn == nil {
+		return nil
+	}
+	return *churn
+}
+
+// HandleCacheChurn serves the CacheChurn as JSON.
+func (server *GeoServer) HandleCacheChurn(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(resp).Encode(server.CacheChurn())
+	if err != nil {
+		log.Errorf("Unable to write cache churn: %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package geoserve
+
+import (
+	"encoding/json"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// DefaultMaxCIDRAddresses is the default limit on the number of addresses
+	// in a range geolocated by HandleCIDR
+	DefaultMaxCIDRAddresses = 1 << 16
+
+	// cidrSamples is the number of addresses of a range that HandleCIDR
+	// geolocates
+	cidrSamples = 16
+)
+
+// cidrResponse is the response of HandleCIDR
+type cidrResponse struct {
+	CIDR           string          `json:"cidr"`
+	Addresses      uint64          `json:"addresses"`
+	Representative string          `json:"representative"`
+	Geolocation    json.RawMessage `json:"geolocation"`
+	Sampled        int             `json:"sampled"`
+	Countries      map[string]int  `json:"countries"`
+	Failed         int             `json:"failed,omitempty"`
+	SameCountry    bool            `json:"same_country"`
+}
+
+// HandleCIDR geolocates the range given by the cidr query parameter, e.g.
+// ?cidr=81.2.69.0/24. It answers with the geolocation of the first address of
+// the range as its representative, along with the number of addresses per
+// country among up to 16 addresses sampled evenly across the range and whether
+// they're all in the same country, e.g.
+// {"cidr":"81.2.69.0/24","addresses":256,"representative":"81.2.69.0","geolocation":{...},
+// "sampled":16,"countries":{"GB":16},"same_country":true}. Ranges of more than
+// the maximum number of addresses (see WithMaxCIDRAddresses) are rejected with
+// 400.
+func (server *GeoServer) HandleCIDR(resp http.ResponseWriter, req *http.Request, allowOrigin string) {
+	setAllowOrigin(resp, req, allowOrigin)
+	if answerPreflight(resp, req) {
+		return
+	}
+	if !server.clientAllowed(req) {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+	cidr := req.URL.Query().Get("cidr")
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		writeJSONError(resp, http.StatusBadRequest, "invalid CIDR: "+cidr)
+		return
+	}
+	ones, bits := ipNet.Mask.Size()
+	hostBits := bits - ones
+	if hostBits >= 64 || uint64(1)<<hostBits > server.maxCIDRAddresses {
+		writeJSONError(resp, http.StatusBadRequest, "CIDR "+cidr+" has more than "+strconv.FormatUint(server.maxCIDRAddresses, 10)+" addresses")
+		return
+	}
+	addresses := uint64(1) << hostBits
+
+	ips := sampleRange(ipNet, addresses, cidrSamples)
+	gr := server.query(get{ip: ips[0]})
+	if gr.res == nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	agg := server.aggregate(ips, AggregateCountry)
+	_, unknown := agg.Counts[unknownAggregateKey]
+	jsonData, err := json.Marshal(&cidrResponse{
+		CIDR:           ipNet.String(),
+		Addresses:      addresses,
+		Representative: ips[0],
+		Geolocation:    gr.res.jsonData,
+		Sampled:        len(ips),
+		Countries:      agg.Counts,
+		Failed:         agg.Failed,
+		SameCountry:    len(agg.Counts) == 1 && !unknown && agg.Failed == 0,
+	})
+	if err != nil {
+		log.Errorf("Unable to encode CIDR response: %v", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(jsonData)
+}
+
+// sampleRange returns up to samples addresses spread evenly across ipNet,
+// which has the given number of addresses, starting with the first and ending
+// with the last
+func sampleRange(ipNet *net.IPNet, addresses uint64, samples int) []string {
+	if addresses < uint64(samples) {
+		samples = int(addresses)
+	}
+	first := new(big.Int).SetBytes(ipNet.IP)
+	ips := make([]string, 0, samples)
+	for i := 0; i < samples; i++ {
+		offset := uint64(0)
+		if samples > 1 {
+			// Avoid overflowing by dividing first
+			step := (addresses - 1) / uint64(samples-1)
+			offset = uint64(i) * step
+			if i == samples-1 {
+				offset = addresses - 1
+			}
+		}
+		n := new(big.Int).Add(first, new(big.Int).SetUint64(offset))
+		ip := make(net.IP, len(ipNet.IP))
+		n.FillBytes(ip)
+		ips = append(ips, ip.String())
+	}
+	return ips
+}
@@ -0,0 +1,23 @@
+package geoserve
+
+import (
+	"time"
+)
+
+// clock abstracts the passage of time so that the update loop can be driven
+// deterministically in tests.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the clock backed by the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
@@ -0,0 +1,64 @@
+package geoserve
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock whose time only moves when the test says so. Each call
+// to After is handed to the test on timers, which decides when it fires.
+type fakeClock struct {
+	mx     sync.Mutex
+	now    time.Time
+	timers chan *fakeTimer
+}
+
+type fakeTimer struct {
+	d  time.Duration
+	ch chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:    time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+		timers: make(chan *fakeTimer, 100),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	timer := &fakeTimer{d: d, ch: make(chan time.Time, 1)}
+	c.timers <- timer
+	return timer.ch
+}
+
+// advance moves the clock forward by d
+func (c *fakeClock) advance(d time.Duration) {
+	c.mx.Lock()
+	c.now = c.now.Add(d)
+	c.mx.Unlock()
+}
+
+// nextTimer waits for the next call to After
+func (c *fakeClock) nextTimer(t *testing.T) *fakeTimer {
+	t.Helper()
+	select {
+	case timer := <-c.timers:
+		return timer
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing waited on the clock")
+		return nil
+	}
+}
+
+// fire advances the clock to the end of the timer and fires it
+func (c *fakeClock) fire(timer *fakeTimer) {
+	c.advance(timer.d)
+	timer.ch <- c.Now()
+}
@@ -0,0 +1,79 @@
+package geoserve
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// notModifiedSince sets the Last-Modified header to the last-modified time of
+// the live database and determines whether the copy of the client making req
+// is at least as new, according to its If-Modified-Since header. As required
+// by HTTP, If-Modified-Since is ignored if the request has If-None-Match,
+// which is checked against the ETag of the response instead.
+func (server *GeoServer) notModifiedSince(resp http.ResponseWriter, req *http.Request) bool {
+	lastModified := server.getDbLastModified()
+	if lastModified.IsZero() {
+		return false
+	}
+	// HTTP dates have a resolution of seconds
+	lastModified = lastModified.Truncate(time.Second)
+	resp.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	if req.Header.Get("If-None-Match") != "" {
+		return false
+	}
+	ifModifiedSince, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !lastModified.After(ifModifiedSince)
+}
+
+// setCacheControl allows clients and shared caches like CDNs to cache the
+// response for the configured max age (see WithCacheMaxAge). Responses about
+// the client's own ip may only be cached by the client.
+func (server *GeoServer) setCacheControl(resp http.ResponseWriter, ownIP bool) {
+	if server.cacheMaxAge <= 0 {
+		return
+	}
+	visibility := "public"
+	if ownIP {
+		visibility = "private"
+	}
+	resp.Header().Set("Cache-Control", visibility+", max-age="+strconv.Itoa(int(server.cacheMaxAge.Seconds())))
+}
+
+// etagFor derives a weak ETag from body. It's weak because the body may be
+// sent compressed.
+func etagFor(body []byte) string {
+	h := fnv.New64a()
+	h.Write(body)
+	return fmt.Sprintf(`W/"%016x"`, h.Sum64())
+}
+
+// etagMatches determines whether the If-None-Match header of req lists etag,
+// using weak comparison
+func etagMatches(req *http.Request, etag string) bool {
+	for _, candidate := range strings.Split(req.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// writeWithETag answers with body and its ETag, or with 304 and no body if
+// the client making req already has it
+func writeWithETag(resp http.ResponseWriter, req *http.Request, body []byte) {
+	etag := etagFor(body)
+	resp.Header().Set("ETag", etag)
+	if etagMatches(req, etag) {
+		resp.WriteHeader(http.StatusNotModified)
+		return
+	}
+	resp.Write(body)
+}
@@ -0,0 +1,47 @@
+package geoserve
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIfModifiedSinceIgnoredForOwnIP(t *testing.T) {
+	server := newTestServer(t)
+	ifModifiedSince := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+
+	for path, expectedStatus := range map[string]int{
+		"/lookup/" + testIP: http.StatusNotModified,
+		// The client may have moved since
+		"/lookup/": http.StatusOK,
+	} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = testClientIP + ":51234"
+		req.Header.Set("If-Modified-Since", ifModifiedSince)
+		resp := httptest.NewRecorder()
+		server.Handle(resp, req, "/lookup/", "")
+		assert.Equal(t, expectedStatus, resp.Code, path)
+	}
+}
+
+func TestVolatileIncludesNotCached(t *testing.T) {
+	server := newTestServer(t, WithCacheMaxAge(time.Hour))
+	req := httptest.NewRequest(http.MethodGet, "/lookup/"+testIP+"?include=db_age", nil)
+	req.Header.Set("If-Modified-Since", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	resp := httptest.NewRecorder()
+	server.Handle(resp, req, "/lookup/", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "private, no-cache", resp.Header().Get("Cache-Control"))
+}
+
+func TestVaryOnEdition(t *testing.T) {
+	server := newTestServer(t, WithCacheMaxAge(time.Hour))
+	resp := httptest.NewRecorder()
+	server.Handle(resp, httptest.NewRequest(http.MethodGet, "/lookup/"+testIP, nil), "/lookup/", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Header().Values("Vary"), "X-Geo-Edition")
+	assert.Contains(t, resp.Header().Get("Cache-Control"), "public")
+}
@@ -0,0 +1,74 @@
+package geoserve
+
+import (
+	"math"
+
+	geoip2 "github.com/oschwald/geoip2-golang"
+)
+
+// maxConfidenceRadiusKm is the accuracy radius at and beyond which a location
+// contributes nothing to the confidence score
+const maxConfidenceRadiusKm = 1000
+
+// ConfidenceWeights are the relative weights of the factors that make up the
+// confidence score of a geolocation, for ?include=confidence. Each factor is
+// between 0 and 1:
+//
+//	Accuracy - 1 - radius/1000 for an accuracy radius in km, so 0 for
+//	           radii of 1000km or more and when the radius is unknown
+//	City     - 1 if the city is known, 0 otherwise
+//	Country  - 1 if the geolocated and registered countries are both known and
+//	           agree, 0 otherwise
+//
+// The score is the weighted average of the factors scaled to 0-100 and
+// rounded to the nearest integer.
+type ConfidenceWeights struct {
+	Accuracy float64
+	City     float64
+	Country  float64
+}
+
+// DefaultConfidenceWeights are the ConfidenceWeights used unless configured
+// otherwise
+var DefaultConfidenceWeights = ConfidenceWeights{Accuracy: 50, City: 30, Country: 20}
+
+// confidenceFor computes the confidence score of record, if it's a
+// *geoip2.City, *geoip2.Enterprise or *geoip2.Country
+func (weights ConfidenceWeights) confidenceFor(record interface{}) (score int, ok bool) {
+	var accuracy, city, country float64
+	switch r := record.(type) {
+	case *geoip2.City:
+		if radius := float64(r.Location.AccuracyRadius); radius > 0 {
+			accuracy = 1 - math.Min(radius, maxConfidenceRadiusKm)/maxConfidenceRadiusKm
+		}
+		if r.City.GeoNameID != 0 {
+			city = 1
+		}
+		country = countriesAgree(r.Country.IsoCode, r.RegisteredCountry.IsoCode)
+	case *geoip2.Enterprise:
+		if radius := float64(r.Location.AccuracyRadius); radius > 0 {
+			accuracy = 1 - math.Min(radius, maxConfidenceRadiusKm)/maxConfidenceRadiusKm
+		}
+		if r.City.GeoNameID != 0 {
+			city = 1
+		}
+		country = countriesAgree(r.Country.IsoCode, r.RegisteredCountry.IsoCode)
+	case *geoip2.Country:
+		country = countriesAgree(r.Country.IsoCode, r.RegisteredCountry.IsoCode)
+	default:
+		return 0, false
+	}
+	total := weights.Accuracy + weights.City + weights.Country
+	if total <= 0 {
+		return 0, true
+	}
+	weighted := weights.Accuracy*accuracy + weights.City*city + weights.Country*country
+	return int(math.Round(100 * weighted / total)), true
+}
+
+func countriesAgree(geoCountry, registeredCountry string) float64 {
+	if geoCountry != "" && geoCountry == registeredCountry {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,63 @@
+package geoserve
+
+import (
+	"net/http"
+	"strings"
+)
+
+// setAllowOrigin sets the Access-Control-Allow-Origin header for req from
+// allowOrigin, a comma-separated list of allowed origins. "*" allows any
+// origin. Otherwise, the request's Origin is echoed back if it's in the list,
+// and no header is set if it isn't. Allowed origins may also read the
+// corsExposedHeaders.
+func setAllowOrigin(resp http.ResponseWriter, req *http.Request, allowOrigin string) {
+	if allowOrigin == "" {
+		return
+	}
+	origin := req.Header.Get("Origin")
+	for _, allowed := range strings.Split(allowOrigin, ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "*" {
+			allowCORS(resp, "*")
+			return
+		}
+	}
+	// the header depends on the Origin, so caches must distinguish by it
+	resp.Header().Add("Vary", "Origin")
+	if origin == "" {
+		return
+	}
+	for _, allowed := range strings.Split(allowOrigin, ",") {
+		if strings.EqualFold(strings.TrimSpace(allowed), origin) {
+			allowCORS(resp, origin)
+			return
+		}
+	}
+}
+
+func allowCORS(resp http.ResponseWriter, origin string) {
+	resp.Header().Set("Access-Control-Allow-Origin", origin)
+	resp.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+}
+
+const (
+	// corsAllowedHeaders are the request headers that lookups make use of
+	corsAllowedHeaders = "Accept-Language, Content-Type, If-Modified-Since, If-None-Match, X-Geo-Edition"
+
+	// corsExposedHeaders are the response headers beyond the CORS-safelisted
+	// ones that scripts may read, so that they can make conditional requests
+	corsExposedHeaders = "ETag"
+)
+
+// answerPreflight answers req with 204 and the methods and headers allowed for
+// cross-origin requests if it's a CORS preflight request, returning whether it
+// was one
+func answerPreflight(resp http.ResponseWriter, req *http.Request) bool {
+	if req.Method != http.MethodOptions {
+		return false
+	}
+	resp.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	resp.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+	resp.WriteHeader(http.StatusNoContent)
+	return true
+}
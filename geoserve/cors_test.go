@@ -0,0 +1,39 @@
+package geoserve
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCORSAllowsConditionalRequests(t *testing.T) {
+	server := newTestServer(t)
+
+	req := httptest.NewRequest(http.MethodOptions, "/lookup/"+testIP, nil)
+	req.Header.Set("Origin", "https://example.com")
+	resp := httptest.NewRecorder()
+	server.Handle(resp, req, "/lookup/", "https://example.com")
+	require.Equal(t, http.StatusNoContent, resp.Code)
+	allowed := resp.Header().Get("Access-Control-Allow-Headers")
+	assert.Contains(t, strings.Split(allowed, ", "), "If-None-Match")
+
+	req = httptest.NewRequest(http.MethodGet, "/lookup/"+testIP, nil)
+	req.Header.Set("Origin", "https://example.com")
+	resp = httptest.NewRecorder()
+	server.Handle(resp, req, "/lookup/", "https://example.com")
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "https://example.com", resp.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "ETag", resp.Header().Get("Access-Control-Expose-Headers"))
+	assert.NotEmpty(t, resp.Header().Get("ETag"))
+
+	// Disallowed origins don't get to read anything
+	req.Header.Set("Origin", "https://evil.example.com")
+	resp = httptest.NewRecorder()
+	server.Handle(resp, req, "/lookup/", "https://example.com")
+	assert.Empty(t, resp.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, resp.Header().Get("Access-Control-Expose-Headers"))
+}
@@ -0,0 +1,40 @@
+package geoserve
+
+import (
+	"bytes"
+	"encoding/csv"
+	"net/http"
+	"strconv"
+)
+
+// csvColumns are the columns of CSV responses
+var csvColumns = []string{"ip", "country_iso", "country_name", "region", "city", "latitude", "longitude", "time_zone"}
+
+// csvRowFor returns the values of the csvColumns for record, the result for
+// ip, leaving those the record doesn't have empty. Names are in English.
+func csvRowFor(ip string, record interface{}) []string {
+	f := flatRecordFor(ip, record)
+	row := []string{f.IP, f.Country, f.CountryName, f.Region, f.City, "", "", f.TimeZone}
+	if f.Latitude != nil {
+		row[5] = strconv.FormatFloat(*f.Latitude, 'f', -1, 64)
+		row[6] = strconv.FormatFloat(*f.Longitude, 'f', -1, 64)
+	}
+	return row
+}
+
+// writeCSV answers with a header row of the csvColumns followed by the
+// csvRowFor record
+func writeCSV(resp http.ResponseWriter, req *http.Request, ip string, record interface{}) {
+	var body bytes.Buffer
+	w := csv.NewWriter(&body)
+	w.Write(csvColumns)
+	w.Write(csvRowFor(ip, record))
+	w.Flush()
+	if err := w.Error(); err != nil {
+		log.Errorf("Unable to write CSV for %v: %v", ip, err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	writeWithETag(resp, req, body.Bytes())
+}
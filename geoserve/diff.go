@@ -0,0 +1,66 @@
+package geoserve
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+
+	errors "github.com/getlantern/errors"
+)
+
+const maxDiffBaselineSize = 1 << 20
+
+// readBaseline reads the previously known record that a diff is computed
+// against from the body of req
+func readBaseline(req *http.Request) (map[string]interface{}, error) {
+	data, err := io.ReadAll(io.LimitReader(req.Body, maxDiffBaselineSize))
+	if err != nil {
+		return nil, errors.New("unable to read baseline: %v", err)
+	}
+	var baseline map[string]interface{}
+	err = json.Unmarshal(data, &baseline)
+	if err != nil {
+		return nil, errors.New("baseline must be a JSON object: %v", err)
+	}
+	return baseline, nil
+}
+
+// diffAgainst returns the JSON object containing only those fields of jsonData
+// that differ from baseline. Nested objects are diffed recursively, other
+// values (including arrays) are compared as a whole. Fields of baseline that are
+// missing from jsonData are reported as null.
+func diffAgainst(baseline map[string]interface{}, jsonData []byte) ([]byte, error) {
+	var current map[string]interface{}
+	err := json.Unmarshal(jsonData, &current)
+	if err != nil {
+		return nil, errors.New("unable to decode json for diffing: %v", err)
+	}
+	return json.Marshal(diffObjects(baseline, current))
+}
+
+func diffObjects(baseline, current map[string]interface{}) map[string]interface{} {
+	changed := make(map[string]interface{})
+	for name, value := range current {
+		prior, found := baseline[name]
+		if !found {
+			changed[name] = value
+			continue
+		}
+		priorObject, priorIsObject := prior.(map[string]interface{})
+		object, isObject := value.(map[string]interface{})
+		if priorIsObject && isObject {
+			if nested := diffObjects(priorObject, object); len(nested) > 0 {
+				changed[name] = nested
+			}
+		} else if !reflect.DeepEqual(prior, value) {
+			changed[name] = value
+		}
+	}
+	for name := range baseline {
+		if _, found := current[name]; !found {
+			changed[name] = nil
+		}
+	}
+	return changed
+}
@@ -0,0 +1,90 @@
+package geoserve
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+
+	errors "github.com/getlantern/errors"
+	"github.com/getlantern/hidden"
+)
+
+const earthRadiusKm = 6371.0
+
+// haversineKm returns the great-circle distance in kilometers between two
+// coordinates
+func haversineKm(lat1, lon1, lat2, lon2 float64) float64 {
+	toRadians := func(degrees float64) float64 { return degrees * math.Pi / 180 }
+	dLat := toRadians(lat2 - lat1)
+	dLon := toRadians(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
+
+// locatedIP is an ip along with its coordinates
+type locatedIP struct {
+	IP        string  `json:"ip"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// distanceResponse is the response of HandleDistance
+type distanceResponse struct {
+	From       *locatedIP `json:"from"`
+	To         *locatedIP `json:"to"`
+	DistanceKm float64    `json:"distance_km"`
+}
+
+// HandleDistance answers with the great-circle distance between the locations
+// of the from and to query parameters, e.g.
+// /distance?from=66.69.242.177&to=81.2.69.160 returns
+// {"from":{"ip":"66.69.242.177","latitude":30.2672,"longitude":-97.7431},"to":{...},"distance_km":8657.2}.
+// It answers 400 if either ip is invalid or has no known location.
+func (server *GeoServer) HandleDistance(resp http.ResponseWriter, req *http.Request) {
+	if !server.clientAllowed(req) {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+	query := req.URL.Query()
+	from, err := server.locate(query.Get("from"))
+	if err != nil {
+		writeJSONError(resp, http.StatusBadRequest, "from: "+hidden.Clean(err.Error()))
+		return
+	}
+	to, err := server.locate(query.Get("to"))
+	if err != nil {
+		writeJSONError(resp, http.StatusBadRequest, "to: "+hidden.Clean(err.Error()))
+		return
+	}
+	distance := haversineKm(from.Latitude, from.Longitude, to.Latitude, to.Longitude)
+	jsonData, err := json.Marshal(&distanceResponse{
+		From:       from,
+		To:         to,
+		DistanceKm: math.Round(distance*10) / 10,
+	})
+	if err != nil {
+		log.Errorf("Unable to encode distance response: %v", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(jsonData)
+}
+
+// locate looks up the coordinates of ip
+func (server *GeoServer) locate(ip string) (*locatedIP, error) {
+	if net.ParseIP(ip) == nil {
+		return nil, errors.New("invalid ip address %v", ip)
+	}
+	city, err := server.Lookup(ip)
+	if err != nil {
+		return nil, err
+	}
+	latitude, longitude, ok := coordinates(city)
+	if !ok {
+		return nil, errors.New("no known location for %v", ip)
+	}
+	return &locatedIP{ip, latitude, longitude}, nil
+}
@@ -0,0 +1,26 @@
+package geoserve
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// HandleDatabase serves the raw mmdb file of the live database, so that clients
+// can look up ips locally using exactly the same database as the server. It
+// supports conditional and range requests. Since commercial databases may not
+// be redistributed, this should only be served behind RequireAdmin.
+func (server *GeoServer) HandleDatabase(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		resp.Header().Set("Allow", "GET, HEAD")
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	data, dbType := server.getDbData()
+	if data == nil {
+		http.Error(resp, "No database loaded yet", http.StatusServiceUnavailable)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/octet-stream")
+	resp.Header().Set("Content-Disposition", `attachment; filename="`+dbType+`.mmdb"`)
+	http.ServeContent(resp, req, "", server.getDbLastModified(), bytes.NewReader(data))
+}
@@ -0,0 +1,109 @@
+package geoserve
+
+import (
+	gerrors "errors"
+	"net"
+	"strings"
+
+	geoip2 "github.com/oschwald/geoip2-golang"
+)
+
+// Editions of the MaxMind databases, from best to worst
+const (
+	EditionEnterprise = "enterprise"
+	EditionCommercial = "commercial"
+	EditionLite       = "lite"
+)
+
+var (
+	editionRanks = map[string]int{
+		EditionEnterprise: 3,
+		EditionCommercial: 2,
+		EditionLite:       1,
+	}
+
+	errEditionNotLoaded = gerrors.New("requested edition is not loaded")
+)
+
+// lookupFull looks up ip in db with the reader method for its database type,
+// so that the records of e.g. Enterprise and ISP databases have all of their
+// fields. Country databases are looked up as cities, see lookupCity.
+func lookupFull(db *database, ip net.IP) (interface{}, error) {
+	switch dbType := db.mmdb.Metadata.DatabaseType; {
+	case strings.Contains(dbType, "Enterprise"):
+		return db.Enterprise(ip)
+	case strings.HasSuffix(dbType, "-ISP"):
+		return db.ISP(ip)
+	case strings.HasSuffix(dbType, "-Connection-Type"):
+		return db.ConnectionType(ip)
+	case strings.HasSuffix(dbType, "-ASN"):
+		return db.ASN(ip)
+	case strings.HasSuffix(dbType, "-Domain"):
+		return db.Domain(ip)
+	case strings.HasSuffix(dbType, "-Anonymous-IP"):
+		return db.AnonymousIP(ip)
+	default:
+		return lookupCity(db, ip)
+	}
+}
+
+// newFullRecord returns an empty record of the type that lookupFull returns
+// for db
+func newFullRecord(db *database) interface{} {
+	switch dbType := db.mmdb.Metadata.DatabaseType; {
+	case strings.Contains(dbType, "Enterprise"):
+		return &geoip2.Enterprise{}
+	case strings.HasSuffix(dbType, "-ISP"):
+		return &geoip2.ISP{}
+	case strings.HasSuffix(dbType, "-Connection-Type"):
+		return &geoip2.ConnectionType{}
+	case strings.HasSuffix(dbType, "-ASN"):
+		return &geoip2.ASN{}
+	case strings.HasSuffix(dbType, "-Domain"):
+		return &geoip2.Domain{}
+	case strings.HasSuffix(dbType, "-Anonymous-IP"):
+		return &geoip2.AnonymousIP{}
+	default:
+		// geoip2 looks up country databases as cities too
+		return &geoip2.City{}
+	}
+}
+
+// editionOf determines the edition of db from its database type
+func editionOf(db *database) string {
+	dbType := db.Metadata().DatabaseType
+	switch {
+	case strings.HasPrefix(dbType, "GeoLite2-"):
+		return EditionLite
+	case strings.Contains(dbType, "Enterprise"):
+		return EditionEnterprise
+	default:
+		return EditionCommercial
+	}
+}
+
+// readerFor returns the loaded database for the requested edition. If edition
+// is "", the best available database is returned. It must be called with the
+// database read lock held.
+func (server *GeoServer) readerFor(edition string) (*database, error) {
+	var best *database
+	var bestEdition string
+	consider := func(db *database, dbEdition string) {
+		if edition != "" && dbEdition != edition {
+			return
+		}
+		if best == nil || editionRanks[dbEdition] > editionRanks[bestEdition] {
+			best, bestEdition = db, dbEdition
+		}
+	}
+	if server.db != nil {
+		consider(server.db, editionOf(server.db))
+	}
+	for dbEdition, db := range server.editions {
+		consider(db, dbEdition)
+	}
+	if best == nil && edition != "" {
+		return nil, errEditionNotLoaded
+	}
+	return best, nil
+}
@@ -0,0 +1,20 @@
+package geoserve
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDuplicateEditionFilesRejected(t *testing.T) {
+	dbData, err := os.ReadFile("testdata/city.mmdb")
+	require.NoError(t, err)
+	_, err = NewServerFromBytes(dbData, WithEditionFile("testdata/city.mmdb"), WithEditionFile("testdata/city.mmdb"))
+	assert.Error(t, err)
+
+	server, err := NewServerFromBytes(dbData, WithEditionFile("testdata/city.mmdb"))
+	require.NoError(t, err)
+	server.Close()
+}
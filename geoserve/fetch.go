@@ -0,0 +1,305 @@
+package geoserve
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	errors "github.com/getlantern/errors"
+)
+
+const (
+	// emptySHA256 is the hex SHA-256 of an empty payload, as signed for S3
+	// GET requests
+	emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	gcsMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	gcsMetadataTimeout  = 2 * time.Second
+)
+
+// Fetcher fetches databases from URLs of a particular scheme, for example
+// s3://bucket/key. See WithFetcher.
+type Fetcher interface {
+	// Fetch gets the file at rawURL. If ifNoneMatch is set, the response has
+	// status http.StatusNotModified if the file's ETag matches it, otherwise
+	// if the file hasn't been modified since ifModifiedSince. Responses with
+	// status http.StatusOK must have a Last-Modified header, and may have an
+	// ETag and a Content-Type.
+	Fetch(rawURL string, ifModifiedSince time.Time, ifNoneMatch string) (*http.Response, error)
+}
+
+// defaultFetchers returns the Fetchers for the schemes supported out of the
+// box
+func defaultFetchers() map[string]Fetcher {
+	return map[string]Fetcher{
+		"http":  httpFetcher{},
+		"https": httpFetcher{},
+		"file":  fileFetcher{},
+		"s3":    &s3Fetcher{},
+		"gs":    &gcsFetcher{},
+	}
+}
+
+// fetcherFor returns the Fetcher for the scheme of rawURL
+func (server *GeoServer) fetcherFor(rawURL string) (Fetcher, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.New("invalid database URL %v: %v", rawURL, err)
+	}
+	fetcher := server.fetchers[strings.ToLower(u.Scheme)]
+	if fetcher == nil {
+		return nil, errors.New("unsupported database URL scheme %v", u.Scheme)
+	}
+	return fetcher, nil
+}
+
+// conditionalGet sends req, made conditional on ifNoneMatch or
+// ifModifiedSince
+func conditionalGet(req *http.Request, ifModifiedSince time.Time, ifNoneMatch string) (*http.Response, error) {
+	if ifNoneMatch != "" {
+		req.Header.Add("If-None-Match", ifNoneMatch)
+	} else {
+		req.Header.Add("If-Modified-Since", ifModifiedSince.Format(http.TimeFormat))
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// httpFetcher fetches databases with plain HTTP(S) GETs
+type httpFetcher struct{}
+
+func (httpFetcher) Fetch(rawURL string, ifModifiedSince time.Time, ifNoneMatch string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, errors.New("unable to construct HTTP request for file: %v", err)
+	}
+	return conditionalGet(req, ifModifiedSince, ifNoneMatch)
+}
+
+// fileFetcher reads databases from local files given as file:///path, which
+// are considered modified whenever their modification time is later than
+// ifModifiedSince. ifNoneMatch is ignored since files don't have ETags.
+type fileFetcher struct{}
+
+func (fileFetcher) Fetch(rawURL string, ifModifiedSince time.Time, ifNoneMatch string) (*http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(u.Path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	// HTTP dates have a resolution of seconds
+	modTime := info.ModTime().Truncate(time.Second)
+	resp := &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+		Body:       file,
+	}
+	if !modTime.After(ifModifiedSince) {
+		resp.Status, resp.StatusCode = "304 Not Modified", http.StatusNotModified
+	}
+	resp.Header.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	return resp, nil
+}
+
+// s3Fetcher fetches databases given as s3://bucket/key from Amazon S3, or an
+// S3-compatible service at AWS_ENDPOINT_URL. Requests are signed with AWS
+// Signature Version 4 using the credentials in AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and optionally AWS_SESSION_TOKEN for the region in
+// AWS_REGION or AWS_DEFAULT_REGION (default us-east-1). Without credentials,
+// the object must be public.
+type s3Fetcher struct{}
+
+func (*s3Fetcher) Fetch(rawURL string, ifModifiedSince time.Time, ifNoneMatch string) (*http.Response, error) {
+	bucket, key, err := splitBucketURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	region := firstEnv("AWS_REGION", "AWS_DEFAULT_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := strings.TrimSuffix(os.Getenv("AWS_ENDPOINT_URL"), "/")
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	// Path-style, since bucket names with dots don't match S3's certificate
+	// when used as a subdomain
+	req, err := http.NewRequest(http.MethodGet, endpoint+"/"+bucket+"/"+uriEncodePath(key), nil)
+	if err != nil {
+		return nil, errors.New("unable to construct S3 request for %v: %v", rawURL, err)
+	}
+	if accessKey := os.Getenv("AWS_ACCESS_KEY_ID"); accessKey != "" {
+		if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+			req.Header.Set("X-Amz-Security-Token", token)
+		}
+		signS3(req, accessKey, os.Getenv("AWS_SECRET_ACCESS_KEY"), region, time.Now())
+	}
+	return conditionalGet(req, ifModifiedSince, ifNoneMatch)
+}
+
+// signS3 signs req, a request without a body, for S3 in region with AWS
+// Signature Version 4, covering its host and the headers it has so far
+func signS3(req *http.Request, accessKey, secretKey, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptySHA256,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex(canonicalRequest)
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	for _, part := range []string{region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// uriEncodePath escapes each segment of path as S3 expects, leaving only
+// unreserved characters unescaped
+func uriEncodePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = strings.ReplaceAll(url.QueryEscape(segment), "+", "%20")
+	}
+	return strings.Join(segments, "/")
+}
+
+// gcsFetcher fetches databases given as gs://bucket/object from Google Cloud
+// Storage. Requests are authorized with the access token in
+// GOOGLE_OAUTH_ACCESS_TOKEN or, failing that, one for the default service
+// account from the metadata server when running on Google Cloud. Without
+// either, the object must be public.
+type gcsFetcher struct {
+	// mx guards token and expires, the token from the metadata server
+	mx      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (f *gcsFetcher) Fetch(rawURL string, ifModifiedSince time.Time, ifNoneMatch string) (*http.Response, error) {
+	bucket, object, err := splitBucketURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	// The XML API supports the same conditional requests as plain HTTP
+	req, err := http.NewRequest(http.MethodGet, "https://storage.googleapis.com/"+bucket+"/"+uriEncodePath(object), nil)
+	if err != nil {
+		return nil, errors.New("unable to construct GCS request for %v: %v", rawURL, err)
+	}
+	if token := f.accessToken(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return conditionalGet(req, ifModifiedSince, ifNoneMatch)
+}
+
+// accessToken returns the token with which to authorize requests, or "" if
+// none is available
+func (f *gcsFetcher) accessToken() string {
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		return token
+	}
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	if f.token != "" && time.Now().Before(f.expires) {
+		return f.token
+	}
+	req, _ := http.NewRequest(http.MethodGet, gcsMetadataTokenURL, nil)
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := (&http.Client{Timeout: gcsMetadataTimeout}).Do(req)
+	if err != nil {
+		log.Debugf("No access token from metadata server, fetching from GCS anonymously: %v", err)
+		return ""
+	}
+	defer resp.Body.Close()
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Errorf("Unable to get access token from metadata server: unexpected HTTP status %v", resp.Status)
+		return ""
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		log.Errorf("Unable to decode access token from metadata server: %v", err)
+		return ""
+	}
+	// Renew a minute early so that the token doesn't expire mid-request
+	f.token, f.expires = token.AccessToken, time.Now().Add(time.Duration(token.ExpiresIn)*time.Second-time.Minute)
+	return f.token
+}
+
+// splitBucketURL splits a URL like s3://bucket/key into its bucket and key
+func splitBucketURL(rawURL string) (bucket string, key string, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", errors.New("invalid database URL %v: %v", rawURL, err)
+	}
+	key = strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return "", "", errors.New("database URL %v must be of the form %v://bucket/key", rawURL, u.Scheme)
+	}
+	return u.Host, key, nil
+}
+
+// firstEnv returns the value of the first of the environment variables that
+// is set
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,83 @@
+package geoserve
+
+import (
+	"encoding/json"
+	"strings"
+
+	errors "github.com/getlantern/errors"
+)
+
+// parseFields parses the fields query parameter, a comma-separated list of
+// dotted paths like location.latitude,country.iso_code, into the segments of
+// each path. Segments are normalized to snake_case so that they match keys in
+// any casing.
+func parseFields(param string) [][]string {
+	var paths [][]string
+	for _, field := range strings.Split(param, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		segments := strings.Split(field, ".")
+		for i, segment := range segments {
+			segments[i] = recaseKey(segment, CaseSnake)
+		}
+		paths = append(paths, segments)
+	}
+	return paths
+}
+
+// projectFields reduces the JSON object jsonData to the fields at paths (see
+// parseFields). Paths through arrays select the field from each element.
+// Paths that don't exist are ignored.
+func projectFields(jsonData []byte, paths [][]string) ([]byte, error) {
+	var decoded interface{}
+	err := json.Unmarshal(jsonData, &decoded)
+	if err != nil {
+		return nil, errors.New("unable to decode json for projecting fields: %v", err)
+	}
+	projected, found := projectIn(decoded, paths)
+	if !found {
+		projected = map[string]interface{}{}
+	}
+	return json.Marshal(projected)
+}
+
+func projectIn(value interface{}, paths [][]string) (interface{}, bool) {
+	for _, path := range paths {
+		if len(path) == 0 {
+			// The whole value was selected
+			return value, true
+		}
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		projected := make(map[string]interface{})
+		for key, child := range v {
+			normalized := recaseKey(key, CaseSnake)
+			var childPaths [][]string
+			for _, path := range paths {
+				if path[0] == normalized {
+					childPaths = append(childPaths, path[1:])
+				}
+			}
+			if childPaths == nil {
+				continue
+			}
+			if projectedChild, found := projectIn(child, childPaths); found {
+				projected[key] = projectedChild
+			}
+		}
+		return projected, len(projected) > 0
+	case []interface{}:
+		projected := make([]interface{}, 0, len(v))
+		for _, child := range v {
+			if projectedChild, found := projectIn(child, paths); found {
+				projected = append(projected, projectedChild)
+			}
+		}
+		return projected, len(projected) > 0
+	default:
+		return nil, false
+	}
+}
@@ -0,0 +1,56 @@
+package geoserve
+
+import (
+	"encoding/json"
+	"net/http"
+
+	geoip2 "github.com/oschwald/geoip2-golang"
+)
+
+// flatRecord is the flat, denormalized form of a geolocation returned with
+// ?format=flat. All fields are present, with "" or null for those the record
+// doesn't have. Names are in English.
+type flatRecord struct {
+	IP          string   `json:"ip"`
+	Country     string   `json:"country"`
+	CountryName string   `json:"country_name"`
+	Region      string   `json:"region"`
+	RegionName  string   `json:"region_name"`
+	City        string   `json:"city"`
+	Latitude    *float64 `json:"lat"`
+	Longitude   *float64 `json:"lon"`
+	TimeZone    string   `json:"timezone"`
+}
+
+// flatRecordFor flattens record, the result for ip
+func flatRecordFor(ip string, record interface{}) *flatRecord {
+	b := briefOf(record)
+	f := &flatRecord{IP: ip, Country: b.Country, Region: b.Region, City: b.City}
+	_, f.RegionName = regionOf(record)
+	switch r := record.(type) {
+	case *geoip2.City:
+		f.CountryName = r.Country.Names["en"]
+		f.TimeZone = r.Location.TimeZone
+	case *geoip2.Enterprise:
+		f.CountryName = r.Country.Names["en"]
+		f.TimeZone = r.Location.TimeZone
+	case *geoip2.Country:
+		f.CountryName = r.Country.Names["en"]
+	}
+	if latitude, longitude, ok := coordinates(record); ok {
+		f.Latitude, f.Longitude = &latitude, &longitude
+	}
+	return f
+}
+
+// writeFlat answers with the flatRecordFor record as JSON
+func writeFlat(resp http.ResponseWriter, req *http.Request, ip string, record interface{}) {
+	jsonData, err := json.Marshal(flatRecordFor(ip, record))
+	if err != nil {
+		log.Errorf("Unable to encode flat record for %v: %v", ip, err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	writeWithETag(resp, req, jsonData)
+}
@@ -0,0 +1,60 @@
+package geoserve
+
+import (
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Response formats, selected with the format query parameter. JSON is the
+// default.
+const (
+	FormatQueryString = "querystring"
+	FormatCSV         = "csv"
+	FormatXML         = "xml"
+	FormatFlat        = "flat"
+	FormatMsgpack     = "msgpack"
+)
+
+// acceptedFormats are the formats that may also be requested with the Accept
+// header, by media type
+var acceptedFormats = map[string]string{
+	"text/csv":        FormatCSV,
+	"application/xml": FormatXML,
+	"text/xml":        FormatXML,
+
+	"application/msgpack":   FormatMsgpack,
+	"application/x-msgpack": FormatMsgpack,
+}
+
+// acceptedFormat returns the first of the acceptedFormats listed in the Accept
+// header of req, or "" if there is none
+func acceptedFormat(req *http.Request) string {
+	for _, accepted := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err == nil && acceptedFormats[mediaType] != "" {
+			return acceptedFormats[mediaType]
+		}
+	}
+	return ""
+}
+
+// queryStringFor encodes the country, region and city of record as a URL
+// query string like country=US&region=TX&city=Austin, omitting empty fields
+func queryStringFor(record interface{}) string {
+	b := briefOf(record)
+	var params []string
+	for _, param := range [][2]string{{"country", b.Country}, {"region", b.Region}, {"city", b.City}} {
+		if param[1] != "" {
+			params = append(params, param[0]+"="+url.QueryEscape(param[1]))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// writeQueryString answers with the queryStringFor record as text/plain
+func writeQueryString(resp http.ResponseWriter, req *http.Request, record interface{}) {
+	resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writeWithETag(resp, req, []byte(queryStringFor(record)))
+}
@@ -0,0 +1,47 @@
+package geoserve
+
+const (
+	geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+	defaultGeohashPrecision = 7
+	maxGeohashPrecision     = 12
+)
+
+// geohash encodes the given coordinates as a geohash with precision characters
+func geohash(latitude, longitude float64, precision int) string {
+	latRange := [2]float64{-90, 90}
+	lonRange := [2]float64{-180, 180}
+	hash := make([]byte, 0, precision)
+	even := true
+	bit := 0
+	idx := 0
+	for len(hash) < precision {
+		if even {
+			mid := (lonRange[0] + lonRange[1]) / 2
+			if longitude >= mid {
+				idx = idx<<1 | 1
+				lonRange[0] = mid
+			} else {
+				idx = idx << 1
+				lonRange[1] = mid
+			}
+		} else {
+			mid := (latRange[0] + latRange[1]) / 2
+			if latitude >= mid {
+				idx = idx<<1 | 1
+				latRange[0] = mid
+			} else {
+				idx = idx << 1
+				latRange[1] = mid
+			}
+		}
+		even = !even
+		bit++
+		if bit == 5 {
+			hash = append(hash, geohashAlphabet[idx])
+			bit = 0
+			idx = 0
+		}
+	}
+	return string(hash)
+}
@@ -1,18 +1,22 @@
 package geoserve
 
 import (
+	"context"
 	"encoding/json"
 	gerrors "errors"
 	"io"
 	"net"
 	"net/http"
 	"os"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/golang/groupcache/lru"
-	"github.com/mholt/archiver/v3"
 	geoip2 "github.com/oschwald/geoip2-golang"
+	"github.com/oschwald/maxminddb-golang"
 
 	errors "github.com/getlantern/errors"
 
@@ -20,168 +24,1286 @@ import (
 )
 
 const (
+	// CacheSize is the default capacity of each cache
 	CacheSize = 50000
+
+	// DefaultMaxPathLength is the default limit on the length of the request
+	// path beyond the base path.
+	DefaultMaxPathLength = 64
+
+	// DefaultMaxUpdateAge is the default time since the database was last
+	// updated or confirmed current after which the server reports itself
+	// unhealthy
+	DefaultMaxUpdateAge = 24 * time.Hour
+
+	// DefaultDBRefreshInterval is the default time between checks for a new
+	// version of the database at the database URL
+	DefaultDBRefreshInterval = 1 * time.Hour
+
+	// DefaultDBRetryInterval is the default time to wait before checking the
+	// database URL again after a failed check
+	DefaultDBRetryInterval = 5 * time.Minute
+
+	// StdinDB is the dbFile that reads the database from stdin
+	StdinDB = "-"
+
+	// minRestartBackoff and maxRestartBackoff bound the time runForever waits
+	// before restarting a loop that panicked, doubling for every consecutive
+	// panic
+	minRestartBackoff = 1 * time.Second
+	maxRestartBackoff = 1 * time.Minute
 )
 
 var (
 	log            = golog.LoggerFor("go-geoserve")
 	errNotModified = gerrors.New("unmodified")
+	errClosed      = gerrors.New("server closed")
 )
 
 // GeoServer is a server for IP geolocation information
 type GeoServer struct {
-	db       *geoip2.Reader
-	dbURL    string
-	cache    *lru.Cache
-	cacheGet chan get
-	dbUpdate chan *geoip2.Reader
-	isCity   bool
+	// dbMx guards db. Lookups hold the read lock so that they can run
+	// concurrently, while swapping in a new database takes the write lock.
+	dbMx  sync.RWMutex
+	db    *database
+	dbURL string
+	// cacheMx guards caches, lastGood, cacheSizes and lookupCounts. It's an
+	// exclusive lock because even reading a cache reorders its entries.
+	cacheMx  sync.Mutex
+	caches   map[string]cache // by cache mode
+	lastGood cache
+	dbUpdate chan *database
+	// dbRefresh asks keepDbCurrent to check for a new database right away. It's
+	// nil if the database isn't downloaded.
+	dbRefresh chan chan<- refreshResult
+	// dbReady is closed once the first database has been loaded
+	dbReady     chan struct{}
+	dbReadyOnce sync.Once
+	clock       clock
+	// done is closed to stop the background goroutines, after which run
+	// closes stopped
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+
+	cachePolicy      string
+	defaultCacheSize int
+	cacheSizes       map[string]int
+	cacheTTL         time.Duration
+	cacheMaxAge      time.Duration
+	negativeCacheTTL time.Duration
+	staleOnError     bool
+	logRequests      bool
+
+	// mx guards the fields below, which are read outside of run()
+	mx             sync.RWMutex
+	dbLastModified time.Time
+	dbData         []byte
+	dbType         string
+
+	ipLists map[string][]string
+
+	nearestCity bool
+	cities      atomic.Pointer[cityIndex] // of the live database
+
+	editionFiles []string
+	editions     map[string]*database
+
+	lookupTimeout    time.Duration
+	maxPathLength    int
+	maxCIDRAddresses uint64
+	privateIPStatus  int
+
+	shedding    *loadShedding
+	maxInFlight int64
+	inFlight    atomic.Int64
+	lastSwap    atomic.Int64 // unix nanos of the last database update
+
+	updateFailures atomic.Int64 // consecutive failed attempts to update the database
+	lastUpdate     atomic.Int64 // unix nanos of the last successful load or update check
+	maxUpdateAge   time.Duration
+
+	metrics *metrics
+
+	overrideURL string
+	override    *overrideClient
+
+	fetchers map[string]Fetcher // by URL scheme
+
+	sharedCache Cache
+
+	serverIPAddr string
+	serverIPURL  string
+	serverIPTTL  time.Duration
+	serverIP     *serverIP
+
+	defaultLang       string
+	defaultCase       string
+	explicitUnknown   bool
+	reflectIP         bool
+	confidenceWeights ConfidenceWeights
+
+	dbFileAttempts      int
+	dbFileRetryInterval time.Duration
+	dbRefreshInterval   time.Duration
+	dbRetryInterval     time.Duration
+	dbWaitTimeout       time.Duration
+	dbCacheDir          string
+	fallbackDBFile      string
+	expectedDBType      string
+
+	auxiliaryDbs map[string]*auxiliaryDb // by database type
+
+	allowedClientCIDRs []string
+	allowedClientNets  []*net.IPNet
+	trustedProxyCIDRs  []string
+	trustedProxies     []*net.IPNet
+
+	churnInterval time.Duration
+	churn         atomic.Pointer[map[string]CacheChurn]
+
+	autoTune     *CacheAutoTune
+	lookupCounts map[string]*lookupCounts // by cache mode
 }
 
-// get encapsulates a request to geolocate an ip address
+// get encapsulates a request to geolocate an ip address, optionally using a
+// specific database edition
 type get struct {
-	ip   string
-	resp chan []byte
+	ip      string
+	edition string
+	// fresh bypasses the cache and reports database metadata with the result.
+	// Fresh results are only cached if updateCache is set.
+	fresh       bool
+	updateCache bool
+	// raw decodes the record generically rather than as a geoip2 type, which
+	// works with any mmdb schema
+	raw bool
+	// country looks up only the country-level record rather than the city
+	country bool
+	// brief returns only the country, region and city
+	brief bool
+	// timezone returns only the time zone
+	timezone bool
+}
+
+// getResponse is the response to a get
+type getResponse struct {
+	res *result
+	err error
+	hit bool // whether res came from the cache
+}
+
+// result is the geolocation of an ip address, both as the structured record
+// (*geoip2.City or *geoip2.Country) and as its JSON encoding.
+type result struct {
+	record   interface{}
+	jsonData []byte
+	source   string // "override" or "maxmind:<edition>"
+	stale    bool
+	fresh    *freshness
+	empty    bool // the database has no data for the ip
+}
+
+// freshness describes the database that answered a fresh lookup
+type freshness struct {
+	BuildEpoch uint
+	Network    string
 }
 
 // NewServer constructs a new GeoServer using the (optional) uncompressed dbFile.
 // If dbFile is "", then this will fetch the latest GeoLite2-City database from
-// the specified DBURL
-func NewServer(dbFile, dbURL string) (server *GeoServer, err error) {
-	server = &GeoServer{
-		cache:    lru.New(CacheSize),
-		cacheGet: make(chan get, 10000),
-		dbUpdate: make(chan *geoip2.Reader),
+// the specified DBURL, which may also be an s3://, gs:// or file:// URL (see
+// WithFetcher). Unless configured with WithDBWait, NewServer returns before
+// the database is downloaded, see WaitForDB. If dbFile is StdinDB, the
+// database is read from stdin and never updated, as is a dbFile without a
+// dbURL. opts configure optional behavior.
+func NewServer(dbFile, dbURL string, opts ...Option) (server *GeoServer, err error) {
+	server, err = newServer(opts...)
+	if err != nil {
+		return nil, err
 	}
 	var lastModified time.Time
 	server.dbURL = dbURL
-	if dbFile != "" {
-		server.db, lastModified, err = server.readDbFromFile(dbFile)
+	if dbFile == StdinDB {
+		db, lastModified, err := server.readDbFromStdin()
+		if err != nil {
+			return nil, errors.New("unable to read DB from stdin: %v", err)
+		}
+		// stdin can't change, so there's nothing to keep current
+		server.serveStatic(db, lastModified)
+		return server, nil
+	} else if dbFile != "" {
+		server.db, lastModified, err = server.readInitialDbFromFile(dbFile)
 		if err != nil {
 			return nil, errors.New("unable to read DB from file %v: %v", dbFile, err)
 		}
+		server.setDbLastModified(lastModified)
+		server.setDbData(server.db)
+		server.markDBReady()
+		server.recordUpdate(nil)
 	} else {
 		server.dbURL = dbURL
-		// We'll start with an empty DB and will fetch new versions automatically.
+		// Start with the database downloaded by a previous run if there is one,
+		// otherwise with an empty DB. Either way, we'll fetch new versions
+		// automatically.
+		db, persistedLastModified, err := server.readPersistedDb()
+		if err != nil {
+			log.Errorf("Unable to read persisted DB, will download it: %v", err)
+		} else if db != nil {
+			log.Debugf("Loaded persisted DB last modified at %v", persistedLastModified)
+			server.db, lastModified = db, persistedLastModified
+			server.setDbLastModified(lastModified)
+			server.setDbData(server.db)
+			server.markDBReady()
+		} else if server.fallbackDBFile != "" {
+			// Serve the fallback until the first download. Its last-modified
+			// time says nothing about the downloadable database, so it's
+			// neither used to check for a new one nor reported to clients.
+			server.db, _, err = server.readDbFromFile(server.fallbackDBFile)
+			if err != nil {
+				return nil, errors.New("unable to read fallback DB from file %v: %v", server.fallbackDBFile, err)
+			}
+			log.Debugf("Serving fallback DB from %v until the database is downloaded", server.fallbackDBFile)
+			server.setDbData(server.db)
+			server.markDBReady()
+		}
+	}
+	server.start()
+	if dbURL != "" {
+		server.dbRefresh = make(chan chan<- refreshResult)
+		go server.runForever("keepDbCurrent", server.keepDbCurrent)
+	}
+	if server.dbWaitTimeout > 0 {
+		log.Debugf("Waiting up to %v for the database to be downloaded", server.dbWaitTimeout)
+		err = server.WaitForDB(server.dbWaitTimeout)
+		if err != nil {
+			server.Close()
+			return nil, err
+		}
 	}
-	go server.run()
-	go server.keepDbCurrent(lastModified)
 	return
 }
 
+// NewServerFromBytes constructs a new GeoServer using the uncompressed mmdb
+// dbData, for example a database embedded in the binary with go:embed. The
+// database is never updated. opts configure optional behavior.
+func NewServerFromBytes(dbData []byte, opts ...Option) (*GeoServer, error) {
+	server, err := newServer(opts...)
+	if err != nil {
+		return nil, err
+	}
+	db, err := openDb(dbData)
+	if err != nil {
+		return nil, errors.New("unable to open DB: %v", err)
+	}
+	server.serveStatic(db, server.clock.Now())
+	return server, nil
+}
+
+// serveStatic starts serving lookups from db, which is never updated
+func (server *GeoServer) serveStatic(db *database, lastModified time.Time) {
+	server.db = db
+	server.setDbLastModified(lastModified)
+	server.setDbData(db)
+	server.markDBReady()
+	server.recordUpdate(nil)
+	server.start()
+}
+
+// start starts the background goroutines of the server
+func (server *GeoServer) start() {
+	go server.runUntilClosed()
+	server.keepAuxiliaryDbsCurrent()
+}
+
+// newServer constructs a GeoServer without a database, applying and
+// validating opts
+func newServer(opts ...Option) (server *GeoServer, err error) {
+	server = &GeoServer{
+		dbUpdate: make(chan *database),
+		dbReady:  make(chan struct{}),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		clock:    realClock{},
+		metrics:  newMetrics(),
+
+		maxUpdateAge: DefaultMaxUpdateAge,
+
+		dbRefreshInterval: DefaultDBRefreshInterval,
+		dbRetryInterval:   DefaultDBRetryInterval,
+
+		cachePolicy:      CachePolicyLRU,
+		defaultCacheSize: CacheSize,
+
+		maxPathLength:    DefaultMaxPathLength,
+		maxCIDRAddresses: DefaultMaxCIDRAddresses,
+		serverIPTTL:      DefaultServerIPTTL,
+		fetchers:         defaultFetchers(),
+
+		confidenceWeights: DefaultConfidenceWeights,
+
+		reflectIP: true,
+	}
+	for _, opt := range opts {
+		opt(server)
+	}
+	if server.cachePolicy != CachePolicyLRU && server.cachePolicy != CachePolicyLFU {
+		return nil, errors.New("unknown cache policy %v", server.cachePolicy)
+	}
+	if server.allowedClientCIDRs != nil {
+		server.allowedClientNets, err = parseCIDRs(server.allowedClientCIDRs)
+		if err != nil {
+			return nil, errors.New("unable to parse allowed client CIDRs: %v", err)
+		}
+	}
+	server.trustedProxies, err = parseCIDRs(server.trustedProxyCIDRs)
+	if err != nil {
+		return nil, errors.New("unable to parse trusted proxy CIDRs: %v", err)
+	}
+	if !validCase(server.defaultCase) {
+		return nil, errors.New("unknown case %v", server.defaultCase)
+	}
+	if server.autoTune != nil {
+		if server.autoTune.Interval <= 0 || server.autoTune.MinSize <= 0 || server.autoTune.MaxSize < server.autoTune.MinSize {
+			return nil, errors.New("cache auto-tuning needs a positive interval and 0 < min size <= max size")
+		}
+		if server.cacheSizes == nil {
+			server.cacheSizes = make(map[string]int)
+		}
+		server.lookupCounts = make(map[string]*lookupCounts)
+	}
+	server.caches = server.newCaches()
+	if server.staleOnError {
+		server.lastGood = newCache(server.cachePolicy, CacheSize)
+	}
+	server.editions = make(map[string]*database)
+	editionFiles := make(map[string]string, len(server.editionFiles))
+	for _, editionFile := range server.editionFiles {
+		db, _, err := server.readDbFromFile(editionFile)
+		if err != nil {
+			return nil, errors.New("unable to read edition DB from file %v: %v", editionFile, err)
+		}
+		edition := editionOf(db)
+		if existing, found := editionFiles[edition]; found {
+			db.Close()
+			return nil, errors.New("edition DB files %v and %v are both the %v edition", existing, editionFile, edition)
+		}
+		server.editions[edition] = db
+		editionFiles[edition] = editionFile
+	}
+	err = server.loadAuxiliaryDbs()
+	if err != nil {
+		return nil, errors.New("unable to read auxiliary DB: %v", err)
+	}
+	if server.overrideURL != "" {
+		server.override = newOverrideClient(server.overrideURL, server.clock)
+	}
+	if server.serverIPAddr != "" {
+		ip := net.ParseIP(server.serverIPAddr)
+		if ip == nil {
+			return nil, errors.New("invalid server ip %v", server.serverIPAddr)
+		}
+		server.serverIP = &serverIP{fixed: ip.String()}
+	} else if server.serverIPURL != "" {
+		server.serverIP = &serverIP{
+			url:    server.serverIPURL,
+			ttl:    server.serverIPTTL,
+			client: &http.Client{Timeout: serverIPTimeout},
+			clock:  server.clock,
+		}
+	}
+	return server, nil
+}
+
+// Register registers a handler for lookups on mux at basePath, both with and
+// without a trailing slash, one for batch lookups at basePath/batch and one for
+// range lookups at basePath/cidr/. See Handle, HandleBatch and HandleCIDR.
+func (server *GeoServer) Register(mux *http.ServeMux, basePath string, allowOrigin string) {
+	basePath = strings.TrimSuffix(basePath, "/")
+	handler := func(resp http.ResponseWriter, req *http.Request) {
+		server.Handle(resp, req, basePath, allowOrigin)
+	}
+	mux.HandleFunc(basePath, handler)
+	mux.HandleFunc(basePath+"/", handler)
+	mux.HandleFunc(basePath+"/batch", func(resp http.ResponseWriter, req *http.Request) {
+		server.HandleBatch(resp, req, allowOrigin)
+	})
+	cidrHandler := func(resp http.ResponseWriter, req *http.Request) {
+		server.HandleCIDR(resp, req, allowOrigin)
+	}
+	mux.HandleFunc(basePath+"/cidr", cidrHandler)
+	mux.HandleFunc(basePath+"/cidr/", cidrHandler)
+}
+
 // Handle is used to handle requests from an HTTP server. basePath is the path
 // at which the containing request handler is registered, and is used to extract
-// the ip address from the remainder of the path. allowOrigin is the cors
-// response config, if not empty it is written to the response header.
+// the ip address from the remainder of the path. basePath may be given with or
+// without a trailing slash. allowOrigin is the cors response config, a
+// comma-separated list of origins allowed to make requests or "*" for any.
+// OPTIONS requests are answered as CORS preflight requests.
+//
+// The ip may also be given as an integer-encoded IPv4 address, in decimal or
+// 0x-prefixed hex, by prefixing it with "int/", e.g. int/3232235777.
+//
+// Adding ?fields=<paths> returns only the fields at the given comma-separated
+// dotted paths, e.g. fields=location.latitude,location.longitude. Paths match
+// keys in any casing, and paths that don't exist are ignored.
+//
+// Adding ?callback=<name> wraps the JSON response in a call to the named
+// function (JSONP), for clients that can't use CORS. Only JavaScript
+// identifiers like cb or jQuery.cb_123 are allowed as names.
+//
+// Invalid ip addresses are answered with 400, and paths that aren't meant as
+// ip addresses at all, like favicon.ico, with 404.
+//
+// Lookups that take longer than the lookup timeout (see WithLookupTimeout), or
+// are still running when the client goes away, are answered with 503. So are
+// lookups beyond the maximum number in flight (see WithMaxInFlight), right
+// away rather than after waiting for the others.
+//
+// Adding ?fresh=true bypasses the cache (and override service) and includes the
+// database build epoch and matched network in the response. Fresh results are
+// only cached if ?update_cache=true is also given.
+//
+// To get the record exactly as stored in the database, decoded generically
+// rather than as a MaxMind City or Country, prefix the ip with "raw/". This
+// works with custom mmdb files of any schema.
+//
+// To get just the time zone, as {"ip":...,"timezone":...}, prefix the ip with
+// "timezone/". Ips without a time zone are answered with 404.
+//
+// POSTing a previously known record to <ip>/diff responds with only those
+// fields of the current record that differ from it ({} if nothing changed).
+//
+// Responses from the database carry an X-Cache header of HIT or MISS depending
+// on whether they were served from the cache, and an X-Reflected-Ip header
+// with the ip that was looked up unless disabled with WithoutReflectedIP. They
+// also carry an ETag, and requests with a matching If-None-Match header are
+// answered with 304. So are lookups of a given ip with an If-Modified-Since
+// header no older than the database, but not lookups of the client's own ip,
+// which may have changed since. With WithCacheMaxAge, non-fresh, non-stale
+// results carry a Cache-Control header.
+//
+// Clients may select which loaded database edition answers with the
+// X-Geo-Edition header ("lite", "commercial" or "enterprise"). By default, the
+// best available edition is used.
+//
+// Responses are compressed with gzip if the client sends Accept-Encoding: gzip.
+//
+// With WithRequestLogging, a line is logged for each request once it has been
+// answered, see accessLogEntry.log.
 func (server *GeoServer) Handle(resp http.ResponseWriter, req *http.Request, basePath string, allowOrigin string) {
-	if allowOrigin != "" {
-		(resp).Header().Set("Access-Control-Allow-Origin", allowOrigin)
+	resp, access := server.startAccessLog(resp, req)
+	defer access.log()
+	resp, finishResponse := compressResponse(resp, req)
+	defer finishResponse()
+	setAllowOrigin(resp, req, allowOrigin)
+	if answerPreflight(resp, req) {
+		return
+	}
+	if !server.clientAllowed(req) {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+	path := strings.TrimPrefix(req.URL.Path, strings.TrimSuffix(basePath, "/"))
+	path = strings.TrimPrefix(path, "/")
+	if server.maxPathLength > 0 && len(path) > server.maxPathLength {
+		resp.WriteHeader(http.StatusRequestURITooLong)
+		return
 	}
-	path := strings.Replace(req.URL.Path, basePath, "", 1)
 	// Use path as ip
 	ip := path
-	if ip == "" {
-		// When no path supplied, grab remote address or X-Forwarded-For
-		ip = clientIpFor(req)
-	}
-	g := get{ip, make(chan []byte)}
-	server.cacheGet <- g
-	jsonData := <-g.resp
-	if jsonData == nil {
-		resp.WriteHeader(500)
+	raw := strings.HasPrefix(path, "raw/")
+	if raw {
+		ip = strings.TrimPrefix(path, "raw/")
+	}
+	country := strings.HasPrefix(path, "country/")
+	if country {
+		ip = strings.TrimPrefix(path, "country/")
+	}
+	timezone := strings.HasPrefix(path, "timezone/")
+	if timezone {
+		ip = strings.TrimPrefix(path, "timezone/")
+	}
+	if strings.HasPrefix(path, "int/") {
+		var err error
+		ip, err = ipForInt(strings.TrimPrefix(path, "int/"))
+		if err != nil {
+			writeJSONError(resp, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	diff := strings.HasSuffix(ip, "/diff")
+	var baseline map[string]interface{}
+	if diff {
+		ip = strings.TrimSuffix(ip, "/diff")
+		if req.Method != http.MethodPost {
+			resp.Header().Set("Allow", http.MethodPost)
+			resp.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var err error
+		baseline, err = readBaseline(req)
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	ownIP := ip == ""
+	if ownIP {
+		// When no path supplied, look up the client
+		ip = server.ClientIP(req)
+	}
+	access.setIP(ip)
+	if !looksLikeIP(ip) {
+		// Most likely a crawler or bot asking for a file like favicon.ico
+		writeJSONError(resp, http.StatusNotFound, "not an ip address: "+ip)
+		return
+	}
+	if server.privateIPStatus != 0 {
+		if category := ipCategory(ip); category != "" {
+			writeReserved(resp, ip, category, server.privateIPStatus)
+			return
+		}
+	}
+	if net.ParseIP(ip) == nil {
+		writeJSONError(resp, http.StatusBadRequest, "invalid ip address: "+ip)
+		return
+	}
+	query := req.URL.Query()
+	fresh := query.Get("fresh") == "true"
+	format := query.Get("format")
+	resp.Header().Add("Vary", "Accept")
+	// Clients may pick the edition that answers
+	resp.Header().Add("Vary", "X-Geo-Edition")
+	if format == "" {
+		format = acceptedFormat(req)
+	}
+	switch format {
+	case "", FormatXML, FormatMsgpack:
+	case FormatQueryString, FormatCSV, FormatFlat:
+		if raw || diff || timezone {
+			http.Error(resp, "Unsupported format: "+format, http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(resp, "Unsupported format: "+format, http.StatusBadRequest)
+		return
+	}
+	callback := query.Get("callback")
+	if callback != "" && (!validCallback(callback) || format != "") {
+		http.Error(resp, "Unsupported callback: "+callback, http.StatusBadRequest)
+		return
+	}
+	keyCase := server.defaultCase
+	if query.Has("case") {
+		keyCase = query.Get("case")
+		if !validCase(keyCase) {
+			http.Error(resp, "Unsupported case: "+keyCase, http.StatusBadRequest)
+			return
+		}
+	}
+	inc, err := includesFor(req)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The age of the database changes by the second, so responses including
+	// it can't be reused
+	volatile := inc.fields["db_age"]
+	brief := false
+	if mode := query.Get("mode"); mode != "" {
+		if mode != ModeBrief || raw || country || timezone {
+			http.Error(resp, "Unsupported mode: "+mode, http.StatusBadRequest)
+			return
+		}
+		brief = true
+	}
+	// The query string has the same fields as the brief mode
+	brief = brief || (format == FormatQueryString && !country)
+	// Results from the database only change when it's updated, unless
+	// they're for the client's own ip, which may have changed since, or
+	// overridden, which happens independently of the database
+	if !fresh && !diff && !ownIP && !volatile && server.override == nil && server.notModifiedSince(resp, req) {
+		server.setCacheControl(resp, ownIP)
+		resp.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if server.shouldShed() {
+		writeShed(resp)
+		return
+	}
+	if !server.startLookup() {
+		writeOverloaded(resp)
+		return
+	}
+	g := get{
+		ip:          ip,
+		edition:     strings.ToLower(strings.TrimSpace(req.Header.Get("X-Geo-Edition"))),
+		fresh:       fresh,
+		updateCache: query.Get("update_cache") == "true",
+		raw:         raw,
+		country:     country,
+		brief:       brief,
+		timezone:    timezone,
+	}
+	// Without a timeout, there's no point in abandoning the lookup, which
+	// would carry on anyway
+	ctx := context.Background()
+	if server.lookupTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(req.Context(), server.lookupTimeout)
+		defer cancel()
+	}
+	// The lookup stays in flight until it's over, even if it times out,
+	// so that abandoned lookups still count towards shedding
+	gr := server.queryContext(ctx, g, server.finishLookup)
+	if gr.err == errEditionNotLoaded {
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if gr.err != nil && gr.err == ctx.Err() {
+		writeJSONError(resp, http.StatusServiceUnavailable, "lookup timed out")
+		return
+	}
+	if gr.hit {
+		resp.Header().Set("X-Cache", "HIT")
 	} else {
+		resp.Header().Set("X-Cache", "MISS")
+	}
+	res := gr.res
+	access.setResult(res)
+	if res == nil {
+		resp.WriteHeader(500)
+		return
+	}
+	if server.reflectIP {
 		resp.Header().Set("X-Reflected-Ip", ip)
-		resp.Write(jsonData)
 	}
+	if res.empty && server.explicitUnknown {
+		writeUnknown(resp, ip)
+		return
+	}
+	if timezone && timeZoneOf(res.record) == "" {
+		writeJSONError(resp, http.StatusNotFound, "no timezone for ip address: "+ip)
+		return
+	}
+	if volatile {
+		resp.Header().Set("Cache-Control", "private, no-cache")
+	} else if !fresh && !res.stale {
+		server.setCacheControl(resp, ownIP)
+	}
+	if format == FormatQueryString {
+		writeQueryString(resp, req, res.record)
+		return
+	}
+	if format == FormatCSV {
+		writeCSV(resp, req, ip, res.record)
+		return
+	}
+	if format == FormatFlat {
+		writeFlat(resp, req, ip, res.record)
+		return
+	}
+	jsonData, err := server.augment(res, inc, ip)
+	resp.Header().Add("Vary", "Accept-Language")
+	if langs := server.langsFor(req); err == nil && langs != nil {
+		jsonData, err = collapseNames(jsonData, langs)
+	}
+	if err == nil && keyCase != "" {
+		jsonData, err = recase(jsonData, keyCase)
+	}
+	if err == nil && diff {
+		jsonData, err = diffAgainst(baseline, jsonData)
+	}
+	if fields := query.Get("fields"); err == nil && fields != "" {
+		jsonData, err = projectFields(jsonData, parseFields(fields))
+	}
+	if err == nil && format == FormatXML {
+		jsonData, err = jsonToXML(jsonData)
+		resp.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	}
+	if err == nil && format == FormatMsgpack {
+		jsonData, err = jsonToMsgpack(jsonData)
+		resp.Header().Set("Content-Type", "application/msgpack")
+	}
+	if err != nil {
+		log.Error(err)
+		resp.WriteHeader(500)
+		return
+	}
+	if callback != "" {
+		jsonData = wrapJSONP(callback, jsonData)
+		resp.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+		resp.Header().Set("X-Content-Type-Options", "nosniff")
+	}
+	writeWithETag(resp, req, jsonData)
+}
+
+// Lookup geolocates ip to the city level, consulting the override service (see
+// WithOverrideURL) and the cache like Handle does. The returned record is
+// shared with the cache and must not be modified.
+func (server *GeoServer) Lookup(ip string) (*geoip2.City, error) {
+	return server.LookupContext(context.Background(), ip)
+}
+
+// LookupContext is like Lookup, but gives up waiting for the lookup once ctx is
+// done, returning ctx.Err().
+func (server *GeoServer) LookupContext(ctx context.Context, ip string) (*geoip2.City, error) {
+	if net.ParseIP(ip) == nil {
+		return nil, errors.New("invalid ip address %v", ip)
+	}
+	gr := server.queryContext(ctx, get{ip: ip}, nil)
+	if gr.err != nil {
+		return nil, gr.err
+	}
+	res := gr.res
+	if res == nil {
+		return nil, errors.New("unable to look up ip address %v", ip)
+	}
+	switch record := res.record.(type) {
+	case *geoip2.City:
+		return record, nil
+	case *geoip2.Enterprise:
+		// Enterprise records are a superset of city records
+		city := &geoip2.City{}
+		err := json.Unmarshal(res.jsonData, city)
+		if err != nil {
+			return nil, errors.New("unable to convert enterprise record for ip address %v: %v", ip, err)
+		}
+		return city, nil
+	default:
+		return nil, errors.New("no city record for ip address %v", ip)
+	}
+}
+
+// LookupJSON geolocates ip, returning the same JSON that Handle serves for it
+// when no optional fields are requested.
+func (server *GeoServer) LookupJSON(ip string) ([]byte, error) {
+	if net.ParseIP(ip) == nil {
+		return nil, errors.New("invalid ip address %v", ip)
+	}
+	gr := server.query(get{ip: ip})
+	if gr.err != nil {
+		return nil, gr.err
+	}
+	if gr.res == nil {
+		return nil, errors.New("unable to look up ip address %v", ip)
+	}
+	return gr.res.jsonData, nil
+}
+
+// WaitForDB waits up to timeout for the first database to be loaded, which
+// for servers without a dbFile happens in the background after NewServer
+// returns.
+func (server *GeoServer) WaitForDB(timeout time.Duration) error {
+	select {
+	case <-server.dbReady:
+		return nil
+	case <-time.After(timeout):
+		return errors.New("no database loaded after %v", timeout)
+	}
+}
+
+func (server *GeoServer) markDBReady() {
+	server.dbReadyOnce.Do(func() { close(server.dbReady) })
+}
+
+// query looks up g, unless the server has been closed
+func (server *GeoServer) query(g get) getResponse {
+	select {
+	case <-server.done:
+		return getResponse{err: errClosed}
+	default:
+	}
+	start := time.Now()
+	gr := server.get(g)
+	server.metrics.observeLookup(time.Since(start))
+	return gr
 }
 
-// run runs the geolocation routine which takes care of looking up values from
-// the cache, updating the cache and udpating the database when a new version is
-// available.
+// queryContext is like query, but gives up waiting for the lookup once ctx is
+// done, answering with ctx.Err(). The lookup itself carries on in the
+// background, so that it still populates the cache. finished, if not nil, is
+// called once the lookup is actually over, for example to stop counting it as
+// in flight.
+func (server *GeoServer) queryContext(ctx context.Context, g get, finished func()) getResponse {
+	if finished == nil {
+		finished = func() {}
+	}
+	if ctx.Done() == nil {
+		// Can't be done, no need for a goroutine
+		defer finished()
+		return server.query(g)
+	}
+	if err := ctx.Err(); err != nil {
+		finished()
+		return getResponse{err: err}
+	}
+	resp := make(chan getResponse, 1)
+	go func() {
+		defer finished()
+		resp <- server.query(g)
+	}()
+	select {
+	case gr := <-resp:
+		return gr
+	case <-ctx.Done():
+		return getResponse{err: ctx.Err()}
+	}
+}
+
+// Close stops the background goroutines of the server and closes its
+// databases. Lookups made after Close fail.
+func (server *GeoServer) Close() error {
+	server.closeOnce.Do(func() {
+		close(server.done)
+		<-server.stopped
+		server.dbMx.Lock()
+		if server.db != nil {
+			server.db.Close()
+			server.db = nil
+		}
+		for _, db := range server.editions {
+			db.Close()
+		}
+		server.editions = nil
+		server.dbMx.Unlock()
+		server.closeAuxiliaryDbs()
+	})
+	return nil
+}
+
+// runUntilClosed runs the run loop until the server is closed
+func (server *GeoServer) runUntilClosed() {
+	server.runForever("run", server.run)
+	close(server.stopped)
+}
+
+// run runs the background routine which takes care of swapping in new versions
+// of the database as they become available and of the periodic cache
+// maintenance.
 func (server *GeoServer) run() {
+	var churnTick <-chan time.Time
+	if server.churnInterval > 0 {
+		ticker := time.NewTicker(server.churnInterval)
+		defer ticker.Stop()
+		churnTick = ticker.C
+	}
+	var autoTuneTick <-chan time.Time
+	if server.autoTune != nil {
+		ticker := time.NewTicker(server.autoTune.Interval)
+		defer ticker.Stop()
+		autoTuneTick = ticker.C
+	}
 	for {
 		select {
-		case g := <-server.cacheGet:
-
-			if cached, found := server.cache.Get(g.ip); found {
-				log.Trace("Cache hit")
-				g.resp <- cached.([]byte)
-			} else {
-				jsonData, err := server.lookupDB(g.ip)
-				if err != nil {
-					log.Error(err)
-				} else {
-					server.cache.Add(g.ip, jsonData)
-				}
-				g.resp <- jsonData
-			}
+		case <-server.done:
+			return
+		case <-churnTick:
+			server.recordChurn()
+		case <-autoTuneTick:
+			server.tuneCaches()
 		case db := <-server.dbUpdate:
-			if server.db != nil {
-				log.Debug("Closing old database")
-				server.db.Close()
+			server.swapDb(db)
+		}
+	}
+}
+
+// swapDb replaces the current database with db and clears the caches. Lookups
+// in progress finish against the old database before it's closed.
+func (server *GeoServer) swapDb(db *database) {
+	log.Debug("Applying new database")
+	server.dbMx.Lock()
+	old := server.db
+	server.db = db
+	log.Debug("Clearing cached lookups")
+	server.cacheMx.Lock()
+	server.caches = server.newCaches()
+	server.cacheMx.Unlock()
+	server.dbMx.Unlock()
+	if old != nil {
+		log.Debug("Closing old database")
+		old.Close()
+	}
+	server.setDbLastModified(db.lastModified)
+	server.setDbData(db)
+	server.markDBReady()
+	server.lastSwap.Store(server.clock.Now().UnixNano())
+}
+
+// get answers g from the override service (see WithOverrideURL), the cache or
+// the database. If the lookup panics, the panic is logged and g is answered
+// with an error. The database read lock is held throughout so that a result
+// from an old database is never cached after the caches have been cleared for
+// a new one.
+func (server *GeoServer) get(g get) (gr getResponse) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Errorf("Recovered from panic looking up %v: %v\n%s", g.ip, p, debug.Stack())
+			gr = getResponse{err: errors.New("panic looking up %v: %v", g.ip, p)}
+		}
+	}()
+	// Consulted before taking the lock, so that a slow service doesn't hold
+	// up database updates. Fresh lookups are about the database, so they
+	// skip it.
+	var override *result
+	if server.override != nil && !g.fresh {
+		override = server.override.lookup(g.ip)
+	}
+	server.dbMx.RLock()
+	defer server.dbMx.RUnlock()
+	if override != nil {
+		if gr, ok := server.getOverride(g, override); ok {
+			return gr
+		}
+	}
+
+	cacheKey := g.ip
+	if g.edition != "" {
+		cacheKey = g.edition + "/" + cacheKey
+	}
+	if g.raw {
+		cacheKey = "raw/" + cacheKey
+	}
+	if g.country {
+		cacheKey = "country/" + cacheKey
+	}
+	if g.brief {
+		cacheKey = "brief/" + cacheKey
+	}
+	if g.timezone {
+		cacheKey = "timezone/" + cacheKey
+	}
+	if g.fresh {
+		return server.getFresh(g, cacheKey)
+	}
+	server.cacheMx.Lock()
+	cached, found := server.cachedResult(g, cacheKey)
+	server.countLookup(g, found)
+	server.cacheMx.Unlock()
+	if found {
+		server.metrics.cacheHits.Add(1)
+	} else {
+		server.metrics.cacheMisses.Add(1)
+	}
+	if found {
+		log.Trace("Cache hit")
+		return getResponse{res: cached, hit: true}
+	}
+	if shared := server.sharedResult(g); shared != nil {
+		server.metrics.sharedCacheHits.Add(1)
+		server.cacheMx.Lock()
+		server.cacheResult(g, cacheKey, shared)
+		server.cacheMx.Unlock()
+		return getResponse{res: shared, hit: true}
+	}
+	res, err := server.lookupDB(g)
+	if err == nil {
+		server.shareResult(g, res)
+	}
+	server.cacheMx.Lock()
+	defer server.cacheMx.Unlock()
+	if err != nil {
+		if err != errEditionNotLoaded {
+			log.Error(err)
+			if stale := server.lastGoodFor(cacheKey); stale != nil {
+				res, err = stale, nil
 			}
-			log.Debug("Applying new database")
-			server.db = db
-			log.Debug("Clearing cached lookups")
-			server.cache = lru.New(CacheSize)
 		}
+	} else {
+		server.cacheResult(g, cacheKey, res)
+		if server.lastGood != nil {
+			server.lastGood.Add(cacheKey, res)
+		}
+	}
+	return getResponse{res: res, err: err}
+}
+
+// getOverride answers g with override, the location from the override service,
+// shaped like g's database would answer it. It returns false if the database
+// doesn't hold locations, so there's nothing to override. It must be called
+// with the database read lock held.
+func (server *GeoServer) getOverride(g get, override *result) (getResponse, bool) {
+	db, err := server.readerFor(g.edition)
+	if err != nil {
+		return getResponse{err: err}, true
 	}
+	res, err := shapeOverride(db, g, override)
+	if err != nil {
+		return getResponse{err: err}, true
+	}
+	return getResponse{res: res}, res != nil
 }
 
-func (server *GeoServer) lookupDB(ip string) ([]byte, error) {
-	if server.db == nil {
+// getFresh answers g from the database, bypassing the cache, and annotates the
+// result with the database's build epoch and the network that matched. It must
+// be called with the database read lock held.
+func (server *GeoServer) getFresh(g get, cacheKey string) getResponse {
+	res, err := server.lookupDB(g)
+	if err != nil {
+		return getResponse{err: err}
+	}
+	if g.updateCache {
+		server.cacheMx.Lock()
+		server.cacheResult(g, cacheKey, res)
+		server.cacheMx.Unlock()
+	}
+	db, _ := server.readerFor(g.edition)
+	network, _, err := db.mmdb.LookupNetwork(net.ParseIP(g.ip), &struct{}{})
+	if err != nil {
+		return getResponse{err: errors.New("Unable to look up network for ip address %s: %s", g.ip, err)}
+	}
+	freshRes := *res
+	freshRes.fresh = &freshness{
+		BuildEpoch: db.Metadata().BuildEpoch,
+		Network:    network.String(),
+	}
+	return getResponse{res: &freshRes}
+}
+
+// runForever runs loop until it returns, logging and restarting it whenever it
+// panics so that a single bad lookup or download doesn't permanently kill the
+// loop. Restarts back off so that a loop that panics every time, e.g. on a
+// malformed download, doesn't spin. It gives up once the server is closed.
+func (server *GeoServer) runForever(name string, loop func()) {
+	backoff := minRestartBackoff
+	for {
+		started := server.clock.Now()
+		returned := func() bool {
+			defer func() {
+				if p := recover(); p != nil {
+					log.Errorf("Recovered from panic in %v: %v\n%s", name, p, debug.Stack())
+				}
+			}()
+			loop()
+			return true
+		}()
+		if returned {
+			return
+		}
+		if server.clock.Now().Sub(started) > maxRestartBackoff {
+			// It ran fine for a while, this isn't a crash loop
+			backoff = minRestartBackoff
+		}
+		log.Debugf("Restarting %v in %v", name, backoff)
+		select {
+		case <-server.clock.After(backoff):
+		case <-server.done:
+			return
+		}
+		backoff *= 2
+		if backoff > maxRestartBackoff {
+			backoff = maxRestartBackoff
+		}
+	}
+}
+
+// lastGoodFor returns the last successful result for cacheKey, marked as
+// stale, or nil if serving stale results is disabled or there is none. It must
+// be called with cacheMx held.
+func (server *GeoServer) lastGoodFor(cacheKey string) *result {
+	if server.lastGood == nil {
+		return nil
+	}
+	cached, found := server.lastGood.Get(cacheKey)
+	if !found {
+		return nil
+	}
+	log.Debugf("Serving stale result for %v", cacheKey)
+	res := *cached.(*result)
+	res.stale = true
+	return &res
+}
+
+// lookupCity looks up ip as a city if db supports it, falling back to a
+// country lookup for country databases
+func lookupCity(db *database, ip net.IP) (interface{}, error) {
+	city, err := db.City(ip)
+	if _, unsupported := err.(geoip2.InvalidMethodError); unsupported {
+		return db.Country(ip)
+	}
+	return city, err
+}
+
+// lookupDB answers g from the database. It must be called with the database
+// read lock held.
+func (server *GeoServer) lookupDB(g get) (*result, error) {
+	ip := g.ip
+	db, err := server.readerFor(g.edition)
+	if err != nil {
+		return nil, err
+	}
+	if db == nil {
 		return nil, errors.New("No database available")
 	}
 	var geoData interface{}
-	var err error
-	if server.isCity {
-		geoData, err = server.db.City(net.ParseIP(ip))
+	if g.raw {
+		var record map[string]interface{}
+		err = db.mmdb.Lookup(net.ParseIP(ip), &record)
+		geoData = record
+	} else if g.country {
+		geoData, err = db.Country(net.ParseIP(ip))
 	} else {
-		geoData, err = server.db.Country(net.ParseIP(ip))
+		geoData, err = lookupFull(db, net.ParseIP(ip))
 	}
 	if err != nil {
 		return nil, errors.New("Unable to look up ip address %s: %s", ip, err)
 	}
+	empty := isEmptyRecord(geoData)
+	if g.brief {
+		return toBrief(&result{record: geoData, source: "maxmind:" + editionOf(db), empty: empty})
+	}
+	if g.timezone {
+		return toTimezone(ip, &result{record: geoData, source: "maxmind:" + editionOf(db), empty: empty})
+	}
 	jsonData, err := json.Marshal(geoData)
 	if err != nil {
 		return nil, errors.New("Unable to encode json response for ip address: %s", ip)
 	}
-	return jsonData, nil
+	return &result{record: geoData, jsonData: jsonData, source: "maxmind:" + editionOf(db), empty: empty}, nil
+}
+
+// keepDbCurrent checks the MaxMind database URL every refresh interval and
+// downloads it if it's newer than the live database and submits it to
+// server.dbUpdate for the run() routine to pick up.
+func (server *GeoServer) keepDbCurrent() {
+	// Restarted after a panic, this picks up the version downloaded so far
+	lastModified, etag := server.liveDbVersion()
+	server.keepCurrent(server.dbURL, server.expectedDBType, lastModified, etag, server.submitDb, server.recordUpdate, server.dbRefresh)
+}
+
+// submitDb persists db, downloaded from the web, and hands it to the run loop
+// to replace the live database
+func (server *GeoServer) submitDb(db *database) error {
+	err := server.persistDb(db, db.lastModified)
+	if err != nil {
+		log.Errorf("Unable to persist DB: %v", err)
+	}
+	select {
+	case server.dbUpdate <- db:
+		return nil
+	case <-server.done:
+		db.Close()
+		return errClosed
+	}
 }
 
-// keepDbCurrent checks the MaxMind database URL every hour and downloads it if it's
-// newer and submits it to server.dbUpdate for the run() routine to pick up.
-func (server *GeoServer) keepDbCurrent(lastModified time.Time) {
+// keepCurrent keeps a database of dbType current with the one at url until the
+// server is closed, starting from the version last modified at lastModified
+// with the given etag. Each newer version is handed to swap, which owns it from
+// then on. If not nil, checked is told the outcome of every download attempt
+// and refresh asks for an attempt right away.
+func (server *GeoServer) keepCurrent(url, dbType string, lastModified time.Time, etag string, swap func(db *database) error, checked func(err error), refresh <-chan chan<- refreshResult) {
+	var refreshed chan<- refreshResult
 	for {
-		lm, err := server.updateDb(lastModified)
-		if err != nil {
-			log.Errorf("Unable to update database from web %v: %s", server.dbURL, err)
-		} else {
-			lastModified = lm
+		sleepInterval := server.dbRefreshInterval
+		var updated time.Time
+		db, modifiedTime, err := server.readDbFromWeb(url, dbType, lastModified, etag)
+		if checked != nil {
+			checked(err)
+		}
+		if err == nil {
+			db.lastModified = modifiedTime
+			newEtag := db.etag
+			err = swap(db)
+			if err == nil {
+				lastModified, etag, updated = modifiedTime, newEtag, modifiedTime
+			}
+		}
+		if err == errNotModified {
+			log.Debugf("Database at %v not modified", url)
+		} else if err != nil {
+			log.Errorf("Unable to update database from web %v: %s", url, err)
+			sleepInterval = server.dbRetryInterval
+		}
+		if refreshed != nil {
+			refreshed <- refreshResult{lastModified: updated, err: err}
+			refreshed = nil
+		}
+		select {
+		case <-server.clock.After(sleepInterval):
+		case refreshed = <-refresh:
+		case <-server.done:
+			return
 		}
 	}
 }
 
-func (server *GeoServer) updateDb(lastModified time.Time) (time.Time, error) {
-	sleepInterval := 1 * time.Hour
-	defer func() {
-		time.Sleep(sleepInterval)
-	}()
-	db, modifiedTime, err := server.readDbFromWeb(server.dbURL, lastModified)
-	if err == errNotModified {
-		sleepInterval = 5 * time.Minute
-		return time.Time{}, err
+// liveDbVersion returns the last-modified time and ETag of the live database,
+// either of which may be unknown
+func (server *GeoServer) liveDbVersion() (time.Time, string) {
+	server.dbMx.RLock()
+	var etag string
+	if server.db != nil {
+		etag = server.db.etag
+	}
+	server.dbMx.RUnlock()
+	return server.getDbLastModified(), etag
+}
+
+// setDbLastModified records the last-modified time of the live database
+func (server *GeoServer) setDbLastModified(lastModified time.Time) {
+	server.mx.Lock()
+	server.dbLastModified = lastModified
+	server.mx.Unlock()
+}
+
+// getDbLastModified returns the last-modified time of the live database, or the
+// zero time if no database has been loaded yet
+func (server *GeoServer) getDbLastModified() time.Time {
+	server.mx.RLock()
+	defer server.mx.RUnlock()
+	return server.dbLastModified
+}
+
+// setDbData records the raw contents of the live database, which remain valid
+// after the database is closed
+func (server *GeoServer) setDbData(db *database) {
+	server.mx.Lock()
+	server.dbData = db.data
+	server.dbType = db.mmdb.Metadata.DatabaseType
+	server.mx.Unlock()
+	server.indexCities(db)
+}
+
+// getDbData returns the raw contents and type of the live database, or nil if
+// no database has been loaded yet
+func (server *GeoServer) getDbData() ([]byte, string) {
+	server.mx.RLock()
+	defer server.mx.RUnlock()
+	return server.dbData, server.dbType
+}
+
+// readInitialDbFromFile reads the database from dbFile, retrying as configured
+// by WithDBFileRetry in case the file isn't available yet.
+func (server *GeoServer) readInitialDbFromFile(dbFile string) (db *database, lastModified time.Time, err error) {
+	for attempt := 1; ; attempt++ {
+		db, lastModified, err = server.readDbFromFile(dbFile)
+		if err == nil || attempt >= server.dbFileAttempts {
+			return
+		}
+		log.Debugf("Unable to read DB from file on attempt %d of %d, retrying in %v: %v", attempt, server.dbFileAttempts, server.dbFileRetryInterval, err)
+		<-server.clock.After(server.dbFileRetryInterval)
 	}
+}
+
+// readDbFromStdin reads the entire database from stdin. Since stdin has no
+// modification time, the database is considered modified now.
+func (server *GeoServer) readDbFromStdin() (*database, time.Time, error) {
+	dbData, err := io.ReadAll(os.Stdin)
 	if err != nil {
-		sleepInterval = 5 * time.Minute
-		return time.Time{}, err
+		return nil, time.Time{}, errors.New("Unable to read db from stdin: %s", err)
 	}
-	server.dbUpdate <- db
-	return modifiedTime, nil
+	db, err := openDb(dbData)
+	if err != nil {
+		return nil, time.Time{}, errors.New("unable to open db from stdin: %v", err)
+	}
+	return db, server.clock.Now(), nil
 }
 
 // readDbFromFile reads the MaxMind database and timestamp from a file
-func (server *GeoServer) readDbFromFile(dbFile string) (*geoip2.Reader, time.Time, error) {
+func (server *GeoServer) readDbFromFile(dbFile string) (*database, time.Time, error) {
 	dbData, err := os.ReadFile(dbFile)
 	if err != nil {
 		return nil, time.Time{}, errors.New("Unable to read db file %s: %s", dbFile, err)
@@ -199,15 +1321,18 @@ func (server *GeoServer) readDbFromFile(dbFile string) (*geoip2.Reader, time.Tim
 	}
 }
 
-// readDbFromWeb reads the MaxMind database and timestamp from the web
-func (server *GeoServer) readDbFromWeb(url string, ifModifiedSince time.Time) (*geoip2.Reader, time.Time, error) {
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+// readDbFromWeb reads the MaxMind database and timestamp from the web, or
+// wherever the Fetcher for the scheme of url gets it from. If dbType is set,
+// the database must be of that type. If ifNoneMatch is set, the database is
+// only downloaded if its ETag has changed, otherwise only if it has been
+// modified since ifModifiedSince.
+func (server *GeoServer) readDbFromWeb(url string, dbType string, ifModifiedSince time.Time, ifNoneMatch string) (*database, time.Time, error) {
+	fetcher, err := server.fetcherFor(url)
 	if err != nil {
-		return nil, time.Time{}, errors.New("unable to construct HTTP request for file: %v", err)
+		return nil, time.Time{}, err
 	}
-	req.Header.Add("If-Modified-Since", ifModifiedSince.Format(http.TimeFormat))
 	log.Debugf("Requesting database from %s", url)
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := fetcher.Fetch(url, ifModifiedSince, ifNoneMatch)
 	if err != nil {
 		return nil, time.Time{}, errors.New("Unable to get database from '%s': %s", url, err)
 	}
@@ -223,29 +1348,20 @@ func (server *GeoServer) readDbFromWeb(url string, ifModifiedSince time.Time) (*
 		return nil, time.Time{}, errors.New("Unable to parse Last-Modified header %s: %s", lastModified, err)
 	}
 
-	unzipper := archiver.NewTarGz()
-	err = unzipper.Open(resp.Body, 0)
+	dbData, err := extractDb(resp.Body, resp.Header.Get("Content-Type"), dbType)
 	if err != nil {
-		return nil, time.Time{}, errors.New("unable to unzip tar.gz: %v", err)
+		return nil, time.Time{}, err
 	}
-	defer unzipper.Close()
-	for {
-		f, err := unzipper.Read()
-		if err != nil {
-			return nil, time.Time{}, errors.New("unable to read from tar.gz: %v", err)
-		}
-		if f.Name() == "GeoLite2-Country.mmdb" || f.Name() == "GeoLite2-City.mmdb" {
-			dbData, err := io.ReadAll(f)
-			if err != nil {
-				return nil, time.Time{}, errors.New("unable to read %v: %v", f.Name(), err)
-			}
-			db, err := openDb(dbData)
-			if err != nil {
-				return nil, time.Time{}, errors.New("unable to open db: %v", err)
-			}
-			return db, lastModified, nil
-		}
+	db, err := openDb(dbData)
+	if err != nil {
+		return nil, time.Time{}, errors.New("unable to open db: %v", err)
 	}
+	if actual := db.mmdb.Metadata.DatabaseType; dbType != "" && actual != dbType {
+		db.Close()
+		return nil, time.Time{}, errors.New("downloaded a %v database, expected %v", actual, dbType)
+	}
+	db.etag = resp.Header.Get("ETag")
+	return db, lastModified, nil
 }
 
 // getLastModified parses the Last-Modified header from a response
@@ -254,23 +1370,70 @@ func getLastModified(resp *http.Response) (time.Time, error) {
 	return http.ParseTime(lastModified)
 }
 
-// openDb opens a MaxMind in-memory db using the geoip2.Reader
-func openDb(dbData []byte) (*geoip2.Reader, error) {
+// database is an open MaxMind database, accessible both through the typed
+// geoip2.Reader and the underlying maxminddb.Reader
+type database struct {
+	*geoip2.Reader
+	mmdb         *maxminddb.Reader
+	data         []byte // the raw mmdb file
+	lastModified time.Time
+	etag         string // the ETag it was downloaded with, if any
+}
+
+// Close closes both readers
+func (db *database) Close() error {
+	err := db.mmdb.Close()
+	if db.Reader != nil {
+		// Databases of unknown types don't have a geoip2 reader
+		err = db.Reader.Close()
+	}
+	return err
+}
+
+// openDb opens a MaxMind in-memory db using the geoip2.Reader. Databases of
+// types unknown to geoip2 (e.g. custom schemas) are accepted, but can only be
+// queried raw.
+func openDb(dbData []byte) (*database, error) {
 	db, err := geoip2.FromBytes(dbData)
+	if _, unknownType := err.(geoip2.UnknownDatabaseTypeError); unknownType {
+		log.Debugf("Opening database of unknown type for raw lookups: %v", err)
+	} else if err != nil {
+		return nil, errors.New("Unable to open database: %s", err)
+	}
+	mmdb, err := maxminddb.FromBytes(dbData)
 	if err != nil {
 		return nil, errors.New("Unable to open database: %s", err)
-	} else {
-		return db, nil
 	}
+	return &database{Reader: db, mmdb: mmdb, data: dbData}, nil
 }
 
-func clientIpFor(req *http.Request) string {
-	// Client requested their info
-	clientIp := req.Header.Get("X-Forwarded-For")
-	if clientIp == "" {
-		clientIp = strings.Split(req.RemoteAddr, ":")[0]
+// ipForInt converts an integer-encoded IPv4 address in decimal or 0x-prefixed
+// hex to its dotted-quad form
+func ipForInt(encoded string) (string, error) {
+	base := 10
+	digits := encoded
+	if strings.HasPrefix(encoded, "0x") || strings.HasPrefix(encoded, "0X") {
+		base = 16
+		digits = encoded[2:]
+	}
+	n, err := strconv.ParseUint(digits, base, 32)
+	if err != nil {
+		return "", errors.New("invalid integer-encoded IPv4 address %v", encoded)
+	}
+	return net.IPv4(byte(n>>24), byte(n>>16), byte(n>>8), byte(n)).String(), nil
+}
+
+// looksLikeIP determines whether s could be meant as an ip address, that is
+// whether it's made up of only hex digits, dots and colons. Paths like
+// favicon.ico or robots.txt aren't.
+func looksLikeIP(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF.:", c) {
+			return false
+		}
 	}
-	// clientIp may contain multiple ips, use the first
-	ips := strings.Split(clientIp, ",")
-	return strings.TrimSpace(ips[0])
+	return true
 }
@@ -0,0 +1,341 @@
+package geoserve
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	geoip2 "github.com/oschwald/geoip2-golang"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	// testIP is in Berlin according to testdata/city.mmdb
+	testIP = "81.2.69.142"
+
+	// testClientIP is in the United Kingdom according to testdata/city.mmdb
+	testClientIP = "2.125.160.216"
+)
+
+// newTestServer returns a server for testdata/city.mmdb that's closed at the
+// end of the test
+func newTestServer(t testing.TB, opts ...Option) *GeoServer {
+	dbData, err := os.ReadFile("testdata/city.mmdb")
+	require.NoError(t, err)
+	server, err := NewServerFromBytes(dbData, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		server.Close()
+	})
+	return server
+}
+
+func TestRunForeverRestartsAfterPanic(t *testing.T) {
+	clock := newFakeClock()
+	server := newTestServer(t, withClock(clock))
+	var runs int32
+	returned := make(chan struct{})
+	go func() {
+		server.runForever("test", func() {
+			if atomic.AddInt32(&runs, 1) < 4 {
+				panic("boom")
+			}
+		})
+		close(returned)
+	}()
+
+	// Each consecutive panic doubles the wait before the restart
+	for _, expected := range []time.Duration{minRestartBackoff, 2 * minRestartBackoff, 4 * minRestartBackoff} {
+		timer := clock.nextTimer(t)
+		assert.Equal(t, expected, timer.d)
+		clock.fire(timer)
+	}
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("loop didn't return")
+	}
+	assert.EqualValues(t, 4, atomic.LoadInt32(&runs), "loop should have been restarted until it returned")
+}
+
+func TestRunForeverStopsRestartingWhenClosed(t *testing.T) {
+	clock := newFakeClock()
+	server := newTestServer(t, withClock(clock))
+	returned := make(chan struct{})
+	go func() {
+		server.runForever("test", func() {
+			panic("boom")
+		})
+		close(returned)
+	}()
+	clock.nextTimer(t)
+	server.Close()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("loop kept being restarted after the server was closed")
+	}
+}
+
+// panickyCache is a shared cache whose first Get panics
+type panickyCache struct {
+	gets int32
+}
+
+func (c *panickyCache) Get(key string) ([]byte, bool) {
+	if atomic.AddInt32(&c.gets, 1) == 1 {
+		panic("boom")
+	}
+	return nil, false
+}
+
+func (c *panickyCache) Add(key string, value []byte) {}
+
+func TestGetRecoversFromPanic(t *testing.T) {
+	server := newTestServer(t, WithSharedCache(&panickyCache{}))
+
+	gr := server.query(get{ip: testIP})
+	require.Error(t, gr.err)
+	assert.Nil(t, gr.res)
+
+	// The read lock was released, so the server can still swap databases and
+	// answer later lookups
+	server.dbMx.Lock()
+	server.dbMx.Unlock()
+	gr = server.query(get{ip: testIP})
+	require.NoError(t, gr.err)
+	require.NotNil(t, gr.res)
+	assert.Contains(t, string(gr.res.jsonData), "Berlin")
+}
+
+func TestStaleResultsKeptPerMode(t *testing.T) {
+	server := newTestServer(t, WithStaleOnError(), WithDefaultCacheSize(0))
+	gr := server.query(get{ip: testIP, country: true})
+	require.NoError(t, gr.err)
+	_, isCountry := gr.res.record.(*geoip2.Country)
+	require.True(t, isCountry)
+
+	// Break the database
+	server.dbMx.Lock()
+	db := server.db
+	server.db = nil
+	server.dbMx.Unlock()
+	defer func() {
+		server.dbMx.Lock()
+		server.db = db
+		server.dbMx.Unlock()
+	}()
+
+	gr = server.query(get{ip: testIP})
+	assert.Error(t, gr.err, "a city lookup shouldn't be answered with a stale country record")
+	gr = server.query(get{ip: testIP, country: true})
+	require.NoError(t, gr.err)
+	assert.True(t, gr.res.stale)
+	_, isCountry = gr.res.record.(*geoip2.Country)
+	assert.True(t, isCountry)
+}
+
+func TestRegisterHandlesBasePathWithAndWithoutSlash(t *testing.T) {
+	server := newTestServer(t)
+	for _, basePath := range []string{"/lookup", "/lookup/"} {
+		mux := http.NewServeMux()
+		server.Register(mux, basePath, "*")
+		for path, expected := range map[string]string{
+			// Without an ip in the path, the client is looked up
+			"/lookup":           "United Kingdom",
+			"/lookup/":          "United Kingdom",
+			"/lookup/" + testIP: "Berlin",
+		} {
+			t.Run(basePath+" "+path, func(t *testing.T) {
+				req := httptest.NewRequest(http.MethodGet, path, nil)
+				req.RemoteAddr = testClientIP + ":51234"
+				resp := httptest.NewRecorder()
+				mux.ServeHTTP(resp, req)
+				require.Equal(t, http.StatusOK, resp.Code, resp.Body.String())
+				assert.Contains(t, resp.Body.String(), expected)
+			})
+		}
+	}
+}
+
+// benchmarkIPs are looked up in turn by the benchmarks, a mix of ips that are
+// and aren't in testdata/city.mmdb
+var benchmarkIPs = []string{testIP, testClientIP, "81.2.69.1", "1.1.1.1", "8.8.8.8"}
+
+func BenchmarkQueryParallel(b *testing.B) {
+	server := newTestServer(b)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			gr := server.query(get{ip: benchmarkIPs[i%len(benchmarkIPs)]})
+			if gr.err != nil {
+				b.Error(gr.err)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkHandleParallel(b *testing.B) {
+	server := newTestServer(b)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			req := httptest.NewRequest(http.MethodGet, "/lookup/"+benchmarkIPs[i%len(benchmarkIPs)], nil)
+			resp := httptest.NewRecorder()
+			server.Handle(resp, req, "/lookup/", "")
+			if resp.Code != http.StatusOK {
+				b.Errorf("unexpected status %v", resp.Code)
+			}
+			i++
+		}
+	})
+}
+
+func TestKeepDbCurrentBacksOffOnFailure(t *testing.T) {
+	dbData, err := os.ReadFile("testdata/city.mmdb")
+	require.NoError(t, err)
+	lastModified := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var available, requests int32
+	web := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&available) == 0 {
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if req.Header.Get("If-Modified-Since") == lastModified.Format(http.TimeFormat) {
+			resp.WriteHeader(http.StatusNotModified)
+			return
+		}
+		resp.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		resp.Write(dbData)
+	}))
+	defer web.Close()
+
+	clock := newFakeClock()
+	server, err := NewServer("", web.URL+"/city.mmdb", withClock(clock), WithDBRefresh(time.Hour, time.Minute))
+	require.NoError(t, err)
+	defer server.Close()
+
+	// The first download fails, so the loop retries sooner than it refreshes
+	timer := clock.nextTimer(t)
+	assert.Equal(t, time.Minute, timer.d)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&requests))
+	assert.Error(t, server.WaitForDB(0))
+
+	atomic.StoreInt32(&available, 1)
+	clock.fire(timer)
+	timer = clock.nextTimer(t)
+	assert.Equal(t, time.Hour, timer.d, "after a successful download, the loop should wait the refresh interval")
+	require.NoError(t, server.WaitForDB(5*time.Second))
+	gr := server.query(get{ip: testIP})
+	require.NoError(t, gr.err)
+	assert.Contains(t, string(gr.res.jsonData), "Berlin")
+
+	clock.fire(timer)
+	timer = clock.nextTimer(t)
+	assert.Equal(t, time.Hour, timer.d, "an unmodified database isn't a failure")
+	assert.EqualValues(t, 3, atomic.LoadInt32(&requests))
+}
+
+func TestDBFileRetry(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "city.mmdb")
+	clock := newFakeClock()
+	created := make(chan error)
+	go func() {
+		// Create the file while the server waits before its second attempt
+		timer := <-clock.timers
+		assert.Equal(t, time.Second, timer.d)
+		dbData, err := os.ReadFile("testdata/city.mmdb")
+		if err == nil {
+			err = os.WriteFile(dbFile, dbData, 0644)
+		}
+		clock.fire(timer)
+		created <- err
+	}()
+
+	server, err := NewServer(dbFile, "", withClock(clock), WithDBFileRetry(3, time.Second))
+	require.NoError(t, <-created)
+	require.NoError(t, err)
+	defer server.Close()
+	gr := server.query(get{ip: testIP})
+	require.NoError(t, gr.err)
+	assert.Contains(t, string(gr.res.jsonData), "Berlin")
+}
+
+// scriptedFetcher answers each Fetch with the next of its steps
+type scriptedFetcher struct {
+	steps chan func(ifModifiedSince time.Time, ifNoneMatch string) *http.Response
+}
+
+func (f *scriptedFetcher) Fetch(rawURL string, ifModifiedSince time.Time, ifNoneMatch string) (*http.Response, error) {
+	return (<-f.steps)(ifModifiedSince, ifNoneMatch), nil
+}
+
+func TestKeepDbCurrentResumesAfterPanic(t *testing.T) {
+	dbData, err := os.ReadFile("testdata/city.mmdb")
+	require.NoError(t, err)
+	lastModified := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fetcher := &scriptedFetcher{steps: make(chan func(time.Time, string) *http.Response)}
+	clock := newFakeClock()
+	server, err := NewServer("", "test://city.mmdb", withClock(clock), WithFetcher("test", fetcher))
+	require.NoError(t, err)
+	defer server.Close()
+
+	fetcher.steps <- func(time.Time, string) *http.Response {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: io.NopCloser(bytes.NewReader(dbData))}
+		resp.Header.Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		resp.Header.Set("ETag", `"v1"`)
+		return resp
+	}
+	require.NoError(t, server.WaitForDB(5*time.Second))
+	clock.fire(clock.nextTimer(t))
+
+	fetcher.steps <- func(time.Time, string) *http.Response {
+		panic("boom")
+	}
+	restart := clock.nextTimer(t)
+	assert.Equal(t, minRestartBackoff, restart.d)
+	clock.fire(restart)
+
+	checked := make(chan string)
+	fetcher.steps <- func(ifModifiedSince time.Time, ifNoneMatch string) *http.Response {
+		checked <- ifNoneMatch
+		return &http.Response{StatusCode: http.StatusNotModified, Header: make(http.Header), Body: http.NoBody}
+	}
+	assert.Equal(t, `"v1"`, <-checked, "the restarted loop should only download a newer database")
+}
+
+func TestInvalidIntIPAnsweredWithJSON(t *testing.T) {
+	server := newTestServer(t)
+	resp := httptest.NewRecorder()
+	server.Handle(resp, httptest.NewRequest(http.MethodGet, "/lookup/int/banana", nil), "/lookup/", "")
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Equal(t, "application/json", resp.Header().Get("Content-Type"))
+	var body errorResponse
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &body))
+	assert.NotEmpty(t, body.Error)
+}
+
+func TestDBFileWithoutURLNotKeptCurrent(t *testing.T) {
+	clock := newFakeClock()
+	server, err := NewServer("testdata/city.mmdb", "", withClock(clock))
+	require.NoError(t, err)
+	defer server.Close()
+	assert.Nil(t, server.dbRefresh)
+	select {
+	case timer := <-clock.timers:
+		t.Fatalf("unexpected wait of %v, there's no URL to check", timer.d)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
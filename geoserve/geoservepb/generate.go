@@ -0,0 +1,5 @@
+// Package geoservepb holds the gRPC service definition of geoserve and the code
+// generated from it.
+package geoservepb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative geoserve.proto
@@ -0,0 +1,187 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v4.25.1
+// source: geoserve.proto
+
+package geoservepb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	GeoServe_Lookup_FullMethodName      = "/geoserve.v1.GeoServe/Lookup"
+	GeoServe_BatchLookup_FullMethodName = "/geoserve.v1.GeoServe/BatchLookup"
+)
+
+// GeoServeClient is the client API for GeoServe service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type GeoServeClient interface {
+	// Lookup geolocates a single ip address.
+	Lookup(ctx context.Context, in *LookupRequest, opts ...grpc.CallOption) (*LookupResponse, error)
+	// BatchLookup geolocates each ip address streamed to it, answering with a
+	// response per request in the same order. Ips that can't be geolocated are
+	// answered with the error set rather than ending the stream.
+	BatchLookup(ctx context.Context, opts ...grpc.CallOption) (GeoServe_BatchLookupClient, error)
+}
+
+type geoServeClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewGeoServeClient(cc grpc.ClientConnInterface) GeoServeClient {
+	return &geoServeClient{cc}
+}
+
+func (c *geoServeClient) Lookup(ctx context.Context, in *LookupRequest, opts ...grpc.CallOption) (*LookupResponse, error) {
+	out := new(LookupResponse)
+	err := c.cc.Invoke(ctx, GeoServe_Lookup_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *geoServeClient) BatchLookup(ctx context.Context, opts ...grpc.CallOption) (GeoServe_BatchLookupClient, error) {
+	stream, err := c.cc.NewStream(ctx, &GeoServe_ServiceDesc.Streams[0], GeoServe_BatchLookup_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &geoServeBatchLookupClient{stream}
+	return x, nil
+}
+
+type GeoServe_BatchLookupClient interface {
+	Send(*LookupRequest) error
+	Recv() (*LookupResponse, error)
+	grpc.ClientStream
+}
+
+type geoServeBatchLookupClient struct {
+	grpc.ClientStream
+}
+
+func (x *geoServeBatchLookupClient) Send(m *LookupRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *geoServeBatchLookupClient) Recv() (*LookupResponse, error) {
+	m := new(LookupResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// GeoServeServer is the server API for GeoServe service.
+// All implementations must embed UnimplementedGeoServeServer
+// for forward compatibility
+type GeoServeServer interface {
+	// Lookup geolocates a single ip address.
+	Lookup(context.Context, *LookupRequest) (*LookupResponse, error)
+	// BatchLookup geolocates each ip address streamed to it, answering with a
+	// response per request in the same order. Ips that can't be geolocated are
+	// answered with the error set rather than ending the stream.
+	BatchLookup(GeoServe_BatchLookupServer) error
+	mustEmbedUnimplementedGeoServeServer()
+}
+
+// UnimplementedGeoServeServer must be embedded to have forward compatible implementations.
+type UnimplementedGeoServeServer struct {
+}
+
+func (UnimplementedGeoServeServer) Lookup(context.Context, *LookupRequest) (*LookupResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Lookup not implemented")
+}
+func (UnimplementedGeoServeServer) BatchLookup(GeoServe_BatchLookupServer) error {
+	return status.Errorf(codes.Unimplemented, "method BatchLookup not implemented")
+}
+func (UnimplementedGeoServeServer) mustEmbedUnimplementedGeoServeServer() {}
+
+// UnsafeGeoServeServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to GeoServeServer will
+// result in compilation errors.
+type UnsafeGeoServeServer interface {
+	mustEmbedUnimplementedGeoServeServer()
+}
+
+func RegisterGeoServeServer(s grpc.ServiceRegistrar, srv GeoServeServer) {
+	s.RegisterService(&GeoServe_ServiceDesc, srv)
+}
+
+func _GeoServe_Lookup_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LookupRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GeoServeServer).Lookup(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: GeoServe_Lookup_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GeoServeServer).Lookup(ctx, req.(*LookupRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _GeoServe_BatchLookup_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(GeoServeServer).BatchLookup(&geoServeBatchLookupServer{stream})
+}
+
+type GeoServe_BatchLookupServer interface {
+	Send(*LookupResponse) error
+	Recv() (*LookupRequest, error)
+	grpc.ServerStream
+}
+
+type geoServeBatchLookupServer struct {
+	grpc.ServerStream
+}
+
+func (x *geoServeBatchLookupServer) Send(m *LookupResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *geoServeBatchLookupServer) Recv() (*LookupRequest, error) {
+	m := new(LookupRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// GeoServe_ServiceDesc is the grpc.ServiceDesc for GeoServe service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var GeoServe_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "geoserve.v1.GeoServe",
+	HandlerType: (*GeoServeServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Lookup",
+			Handler:    _GeoServe_Lookup_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "BatchLookup",
+			Handler:       _GeoServe_BatchLookup_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "geoserve.proto",
+}
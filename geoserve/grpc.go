@@ -0,0 +1,87 @@
+package geoserve
+
+import (
+	"context"
+	"io"
+	"net"
+
+	geoip2 "github.com/oschwald/geoip2-golang"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/getlantern/go-geoserve/geoserve/geoservepb"
+)
+
+// grpcService implements the GeoServe gRPC service with a GeoServer
+type grpcService struct {
+	geoservepb.UnimplementedGeoServeServer
+	server *GeoServer
+}
+
+// RegisterGRPC registers the GeoServe gRPC service defined in geoservepb on s.
+// Its lookups go through the override service and the cache like Lookup.
+func (server *GeoServer) RegisterGRPC(s *grpc.Server) {
+	geoservepb.RegisterGeoServeServer(s, &grpcService{server: server})
+}
+
+func (svc *grpcService) Lookup(ctx context.Context, req *geoservepb.LookupRequest) (*geoservepb.LookupResponse, error) {
+	if net.ParseIP(req.Ip) == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid ip address: %v", req.Ip)
+	}
+	city, err := svc.server.LookupContext(ctx, req.Ip)
+	if err != nil && err == ctx.Err() {
+		return nil, status.FromContextError(err).Err()
+	}
+	if err == errClosed {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to look up %v: %v", req.Ip, err)
+	}
+	return lookupResponseFor(req.Ip, city), nil
+}
+
+func (svc *grpcService) BatchLookup(stream geoservepb.GeoServe_BatchLookupServer) error {
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		resp, err := svc.Lookup(stream.Context(), req)
+		if err != nil {
+			resp = &geoservepb.LookupResponse{Ip: req.Ip, Error: status.Convert(err).Message()}
+		}
+		err = stream.Send(resp)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// lookupResponseFor converts city, the geolocation of ip, to a LookupResponse
+// with English names
+func lookupResponseFor(ip string, city *geoip2.City) *geoservepb.LookupResponse {
+	resp := &geoservepb.LookupResponse{
+		Ip:                       ip,
+		Found:                    !isEmptyRecord(city),
+		ContinentCode:            city.Continent.Code,
+		CountryIsoCode:           city.Country.IsoCode,
+		CountryName:              city.Country.Names["en"],
+		RegisteredCountryIsoCode: city.RegisteredCountry.IsoCode,
+		CityName:                 city.City.Names["en"],
+		PostalCode:               city.Postal.Code,
+		Latitude:                 city.Location.Latitude,
+		Longitude:                city.Location.Longitude,
+		AccuracyRadius:           uint32(city.Location.AccuracyRadius),
+		TimeZone:                 city.Location.TimeZone,
+	}
+	if len(city.Subdivisions) > 0 {
+		resp.RegionIsoCode = city.Subdivisions[0].IsoCode
+		resp.RegionName = city.Subdivisions[0].Names["en"]
+	}
+	return resp
+}
@@ -0,0 +1,81 @@
+package geoserve
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+// acceptsGzip determines whether the Accept-Encoding header of req allows
+// gzip
+func acceptsGzip(req *http.Request) bool {
+	for _, accepted := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		coding, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err == nil && coding == "gzip" {
+			return params["q"] == "" || strings.Trim(params["q"], "0.") != ""
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter compresses the body written through it with gzip
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+// compressResponse returns the ResponseWriter through which to respond to req,
+// which compresses the body if the client accepts gzip, along with a function
+// to call once the response has been written
+func compressResponse(resp http.ResponseWriter, req *http.Request) (http.ResponseWriter, func()) {
+	resp.Header().Add("Vary", "Accept-Encoding")
+	if !acceptsGzip(req) {
+		return resp, func() {}
+	}
+	w := &gzipResponseWriter{ResponseWriter: resp}
+	return w, w.close
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		// Responses without a body are left alone
+		if status != http.StatusNoContent && status != http.StatusNotModified {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Del("Content-Length")
+			w.gz = gzipWriters.Get().(*gzip.Writer)
+			w.gz.Reset(w.ResponseWriter)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.gz.Write(b)
+}
+
+// close finishes the compressed body, if any
+func (w *gzipResponseWriter) close() {
+	if w.gz == nil {
+		return
+	}
+	err := w.gz.Close()
+	if err != nil {
+		log.Debugf("Unable to finish gzipped response: %v", err)
+	}
+	gzipWriters.Put(w.gz)
+	w.gz = nil
+}
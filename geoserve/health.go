@@ -0,0 +1,77 @@
+package geoserve
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// health reports the state of the database, distinguishing a server that has
+// never loaded a database from one that's serving an old database because
+// updates are failing
+type health struct {
+	DBLoaded                  bool       `json:"db_loaded"`
+	LastModified              *time.Time `json:"last_modified"`
+	LastSuccessfulUpdate      *time.Time `json:"last_successful_update"`
+	ConsecutiveUpdateFailures int64      `json:"consecutive_update_failures"`
+}
+
+// dbLoaded determines whether any database has been loaded yet
+func (server *GeoServer) dbLoaded() bool {
+	select {
+	case <-server.dbReady:
+		return true
+	default:
+		return false
+	}
+}
+
+// recordUpdate tracks the outcome of an attempt to load or update the
+// database. Finding that the database is already current counts as success.
+func (server *GeoServer) recordUpdate(err error) {
+	if err != nil && err != errNotModified {
+		server.updateFailures.Add(1)
+		server.metrics.updateFailures.Add(1)
+		return
+	}
+	server.updateFailures.Store(0)
+	server.metrics.updateSuccesses.Add(1)
+	server.lastUpdate.Store(server.clock.Now().UnixNano())
+}
+
+// HandleHealth serves the health of the database as JSON, for example
+// {"db_loaded":true,"last_modified":"2024-01-01T00:00:00Z","last_successful_update":"2024-01-02T15:04:05Z","consecutive_update_failures":3}.
+// last_successful_update is null until the database has been loaded or
+// confirmed current. The status is 200 if a database is loaded and, for
+// servers that download updates, it was last successfully updated or confirmed
+// current within the configured maximum update age (see WithMaxUpdateAge).
+// Otherwise it's 503, so that load balancers can avoid the server.
+func (server *GeoServer) HandleHealth(resp http.ResponseWriter, req *http.Request) {
+	h := &health{
+		DBLoaded:                  server.dbLoaded(),
+		ConsecutiveUpdateFailures: server.updateFailures.Load(),
+	}
+	if lastModified := server.getDbLastModified(); !lastModified.IsZero() {
+		t := lastModified.UTC()
+		h.LastModified = &t
+	}
+	healthy := h.DBLoaded
+	if lastUpdate := server.lastUpdate.Load(); lastUpdate != 0 {
+		t := time.Unix(0, lastUpdate).UTC()
+		h.LastSuccessfulUpdate = &t
+		if server.dbURL != "" && server.maxUpdateAge > 0 && server.clock.Now().Sub(t) > server.maxUpdateAge {
+			healthy = false
+		}
+	}
+	jsonData, err := json.Marshal(h)
+	if err != nil {
+		log.Errorf("Unable to encode health: %v", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	if !healthy {
+		resp.WriteHeader(http.StatusServiceUnavailable)
+	}
+	resp.Write(jsonData)
+}
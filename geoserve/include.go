@@ -0,0 +1,214 @@
+package geoserve
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	geoip2 "github.com/oschwald/geoip2-golang"
+
+	errors "github.com/getlantern/errors"
+)
+
+// derivedSources describes where the optional fields that don't come from the
+// record itself originate, for ?include=provenance
+var derivedSources = map[string]string{
+	"currency":             "static",
+	"currencies":           "static",
+	"region":               "computed",
+	"region_name":          "computed",
+	"geohash":              "computed",
+	"airport":              "static",
+	"country_flags":        "computed",
+	"confidence":           "computed",
+	"db_age":               "server",
+	"found":                "server",
+	"ip":                   "server",
+	"stale":                "server",
+	"database_build_epoch": "server",
+	"network":              "server",
+}
+
+// includes captures the optional fields requested with the include query
+// parameter, e.g. ?include=currency, along with their parameters
+type includes struct {
+	fields    map[string]bool
+	precision int
+}
+
+// includesFor parses the includes from req, returning an error if any of
+// their parameters are invalid
+func includesFor(req *http.Request) (*includes, error) {
+	query := req.URL.Query()
+	inc := &includes{
+		fields:    make(map[string]bool),
+		precision: defaultGeohashPrecision,
+	}
+	for _, name := range strings.Split(query.Get("include"), ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			inc.fields[name] = true
+		}
+	}
+	if precision := query.Get("precision"); precision != "" {
+		var err error
+		inc.precision, err = strconv.Atoi(precision)
+		if err != nil || inc.precision < 1 || inc.precision > maxGeohashPrecision {
+			return nil, errors.New("precision must be between 1 and %d", maxGeohashPrecision)
+		}
+	}
+	return inc, nil
+}
+
+// augment adds the requested optional fields to the json for res, the result
+// for ip, as well as the stale flag for stale results and the database metadata
+// for fresh ones. If none of these apply, res.jsonData is returned as is.
+func (server *GeoServer) augment(res *result, inc *includes, ip string) ([]byte, error) {
+	fields := make(map[string]interface{})
+	if res.stale {
+		fields["stale"] = true
+	}
+	if res.fresh != nil {
+		fields["database_build_epoch"] = res.fresh.BuildEpoch
+		fields["network"] = res.fresh.Network
+	}
+	if inc.fields["currency"] {
+		if codes := currencies[countryIsoCode(res.record)]; len(codes) > 0 {
+			fields["currency"] = codes[0]
+			if len(codes) > 1 {
+				fields["currencies"] = codes
+			}
+		}
+	}
+	if inc.fields["region"] {
+		if isoCode, name := regionOf(res.record); isoCode != "" || name != "" {
+			fields["region"] = isoCode
+			fields["region_name"] = name
+		}
+	}
+	if inc.fields["geohash"] {
+		if latitude, longitude, ok := coordinates(res.record); ok {
+			fields["geohash"] = geohash(latitude, longitude, inc.precision)
+		}
+	}
+	if inc.fields["airport"] {
+		if latitude, longitude, ok := coordinates(res.record); ok {
+			fields["airport"] = nearestAirportTo(latitude, longitude)
+		}
+	}
+	if inc.fields["country_flags"] {
+		if flags := countryFlagsFor(res.record); flags != nil {
+			fields["country_flags"] = flags
+		}
+	}
+	if inc.fields["confidence"] {
+		if score, ok := server.confidenceWeights.confidenceFor(res.record); ok {
+			fields["confidence"] = score
+		}
+	}
+	if inc.fields["db_age"] {
+		if lastModified := server.getDbLastModified(); !lastModified.IsZero() {
+			// In seconds, like the db_age of HandleVersion
+			fields["db_age"] = int64(server.clock.Now().Sub(lastModified) / time.Second)
+		}
+	}
+	if inc.fields["found"] {
+		fields["found"] = !res.empty
+		fields["ip"] = ip
+	}
+	if len(fields) == 0 && !inc.fields["provenance"] {
+		return res.jsonData, nil
+	}
+
+	merged := make(map[string]json.RawMessage)
+	err := json.Unmarshal(res.jsonData, &merged)
+	if err != nil {
+		return nil, errors.New("unable to decode json for augmenting: %v", err)
+	}
+	for name, value := range fields {
+		merged[name], err = json.Marshal(value)
+		if err != nil {
+			return nil, errors.New("unable to encode %v: %v", name, err)
+		}
+	}
+	if inc.fields["provenance"] {
+		merged["provenance"], err = json.Marshal(provenanceFor(res, merged))
+		if err != nil {
+			return nil, errors.New("unable to encode provenance: %v", err)
+		}
+	}
+	return json.Marshal(merged)
+}
+
+// provenanceFor maps each top-level field in merged to the source that set it:
+// the source of res for fields of the record itself, or the static table or
+// computation that produced the field for optional fields.
+func provenanceFor(res *result, merged map[string]json.RawMessage) map[string]string {
+	provenance := make(map[string]string, len(merged))
+	for name := range merged {
+		if source, derived := derivedSources[name]; derived {
+			provenance[name] = source
+		} else {
+			provenance[name] = res.source
+		}
+	}
+	return provenance
+}
+
+// countryIsoCode returns the ISO code of the geolocated country in record
+func countryIsoCode(record interface{}) string {
+	switch r := record.(type) {
+	case *geoip2.City:
+		return r.Country.IsoCode
+	case *geoip2.Enterprise:
+		return r.Country.IsoCode
+	case *geoip2.Country:
+		return r.Country.IsoCode
+	case *brief:
+		return r.Country
+	default:
+		return ""
+	}
+}
+
+// countryFlags compares the geolocated country of a record to the country in
+// which its network is registered, for ?include=country_flags
+type countryFlags struct {
+	GeoCountry        string `json:"geo_country"`
+	RegisteredCountry string `json:"registered_country"`
+	Diverges          bool   `json:"diverges"`
+}
+
+// countryFlagsFor returns the countryFlags for record, or nil if record has
+// no country information. The countries only diverge if both are known.
+func countryFlagsFor(record interface{}) *countryFlags {
+	var flags *countryFlags
+	switch r := record.(type) {
+	case *geoip2.City:
+		flags = &countryFlags{GeoCountry: r.Country.IsoCode, RegisteredCountry: r.RegisteredCountry.IsoCode}
+	case *geoip2.Enterprise:
+		flags = &countryFlags{GeoCountry: r.Country.IsoCode, RegisteredCountry: r.RegisteredCountry.IsoCode}
+	case *geoip2.Country:
+		flags = &countryFlags{GeoCountry: r.Country.IsoCode, RegisteredCountry: r.RegisteredCountry.IsoCode}
+	default:
+		return nil
+	}
+	flags.Diverges = flags.GeoCountry != "" && flags.RegisteredCountry != "" && flags.GeoCountry != flags.RegisteredCountry
+	return flags
+}
+
+// coordinates returns the location of record, if it has one
+func coordinates(record interface{}) (latitude float64, longitude float64, ok bool) {
+	switch r := record.(type) {
+	case *geoip2.City:
+		latitude, longitude = r.Location.Latitude, r.Location.Longitude
+	case *geoip2.Enterprise:
+		latitude, longitude = r.Location.Latitude, r.Location.Longitude
+	}
+	if latitude == 0 && longitude == 0 {
+		return 0, 0, false
+	}
+	return latitude, longitude, true
+}
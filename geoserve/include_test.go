@@ -0,0 +1,54 @@
+package geoserve
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIncludeDBAgeInSeconds(t *testing.T) {
+	clock := newFakeClock()
+	server := newTestServer(t, withClock(clock))
+	clock.advance(time.Hour)
+
+	resp := httptest.NewRecorder()
+	server.Handle(resp, httptest.NewRequest(http.MethodGet, "/lookup/"+testIP+"?include=db_age", nil), "/lookup/", "")
+	require.Equal(t, http.StatusOK, resp.Code)
+	var record map[string]interface{}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &record))
+	assert.EqualValues(t, 3600, record["db_age"], "db_age should be in seconds, like in /version")
+}
+
+func TestEveryAddedFieldHasSource(t *testing.T) {
+	server := newTestServer(t)
+	gr := server.query(get{ip: testIP})
+	require.NoError(t, gr.err)
+	res := *gr.res
+	res.stale = true
+	res.fresh = &freshness{BuildEpoch: 1, Network: "81.2.69.0/24"}
+	var fromDB map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(res.jsonData, &fromDB))
+
+	inc := &includes{fields: make(map[string]bool), precision: defaultGeohashPrecision}
+	for _, name := range []string{"currency", "region", "geohash", "airport", "country_flags", "confidence", "db_age", "found", "provenance"} {
+		inc.fields[name] = true
+	}
+	jsonData, err := server.augment(&res, inc, testIP)
+	require.NoError(t, err)
+	var merged map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(jsonData, &merged))
+	for name := range merged {
+		if _, isFromDB := fromDB[name]; isFromDB || name == "provenance" {
+			continue
+		}
+		assert.Contains(t, derivedSources, name, "%v doesn't come from the database", name)
+	}
+	assert.Contains(t, merged, "region")
+	assert.Contains(t, merged, "stale")
+	assert.Contains(t, merged, "network")
+}
@@ -0,0 +1,50 @@
+package geoserve
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// inCountryResponse is the response of HandleInCountry
+type inCountryResponse struct {
+	InCountry bool   `json:"in_country"`
+	Actual    string `json:"actual"`
+}
+
+// HandleInCountry answers whether the ip query parameter is geolocated to the
+// country (ISO code) query parameter, e.g. /in-country?ip=66.69.242.177&country=US
+// returns {"in_country":true,"actual":"US"}. Ips without a known country are
+// never in the country and have an empty actual country.
+func (server *GeoServer) HandleInCountry(resp http.ResponseWriter, req *http.Request) {
+	if !server.clientAllowed(req) {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+	query := req.URL.Query()
+	ip := query.Get("ip")
+	country := query.Get("country")
+	if net.ParseIP(ip) == nil || country == "" {
+		http.Error(resp, "ip and country are required", http.StatusBadRequest)
+		return
+	}
+
+	res := server.query(get{ip: ip, country: true}).res
+	if res == nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	actual := countryIsoCode(res.record)
+	jsonData, err := json.Marshal(&inCountryResponse{
+		InCountry: actual != "" && strings.EqualFold(actual, country),
+		Actual:    actual,
+	})
+	if err != nil {
+		log.Errorf("Unable to encode in-country response for %v: %v", ip, err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(jsonData)
+}
@@ -0,0 +1,24 @@
+package geoserve
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// errorResponse is the body of error responses caused by bad input
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// writeJSONError answers with the given status and a {"error":...} body
+func writeJSONError(resp http.ResponseWriter, status int, message string) {
+	jsonData, err := json.Marshal(&errorResponse{message})
+	if err != nil {
+		log.Errorf("Unable to encode error response %v: %v", message, err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	resp.Write(jsonData)
+}
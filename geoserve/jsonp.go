@@ -0,0 +1,29 @@
+package geoserve
+
+import "regexp"
+
+// maxCallbackLength limits the length of JSONP callback names
+const maxCallbackLength = 128
+
+// validCallbackName matches JavaScript identifiers, optionally qualified like
+// jQuery.cb_123, which is all JSONP callbacks need. Anything else could be
+// used to inject script.
+var validCallbackName = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*(\.[A-Za-z_$][A-Za-z0-9_$]*)*$`)
+
+// validCallback determines whether callback is safe to use as a JSONP callback
+func validCallback(callback string) bool {
+	return len(callback) <= maxCallbackLength && validCallbackName.MatchString(callback)
+}
+
+// wrapJSONP wraps jsonData in a call to callback. The leading empty comment
+// keeps the response from being interpreted as anything but script, e.g. as a
+// Flash file.
+func wrapJSONP(callback string, jsonData []byte) []byte {
+	wrapped := make([]byte, 0, len(callback)+len(jsonData)+8)
+	wrapped = append(wrapped, "/**/"...)
+	wrapped = append(wrapped, callback...)
+	wrapped = append(wrapped, '(')
+	wrapped = append(wrapped, jsonData...)
+	wrapped = append(wrapped, ");"...)
+	return wrapped
+}
@@ -0,0 +1,132 @@
+package geoserve
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	errors "github.com/getlantern/errors"
+)
+
+const (
+	// AllLanguages is the value of the lang query parameter that keeps the
+	// full Names maps even when a default language is configured
+	AllLanguages = "all"
+
+	// fallbackLang is used for entities without a name in any of the
+	// requested languages
+	fallbackLang = "en"
+)
+
+// langsFor determines the languages to collapse Names maps to for req, in
+// order of preference, or nil to keep them whole. The lang query parameter
+// takes precedence over the Accept-Language header, which takes precedence
+// over the default language.
+func (server *GeoServer) langsFor(req *http.Request) []string {
+	if lang := req.URL.Query().Get("lang"); lang != "" {
+		if lang == AllLanguages {
+			return nil
+		}
+		return []string{lang}
+	}
+	if langs := acceptedLanguages(req.Header.Get("Accept-Language")); len(langs) > 0 {
+		return langs
+	}
+	if server.defaultLang != "" {
+		return []string{server.defaultLang}
+	}
+	return nil
+}
+
+// acceptedLanguages parses an Accept-Language header like
+// "de-DE,de;q=0.9,en;q=0.8" into its languages ordered by quality, ignoring
+// the wildcard and languages with a quality of 0
+func acceptedLanguages(header string) []string {
+	type weighted struct {
+		lang    string
+		quality float64
+	}
+	var accepted []weighted
+	for _, part := range strings.Split(header, ",") {
+		lang, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		lang = strings.TrimSpace(lang)
+		if lang == "" || lang == "*" {
+			continue
+		}
+		quality := 1.0
+		if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			var err error
+			quality, err = strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+		}
+		if quality > 0 {
+			accepted = append(accepted, weighted{lang, quality})
+		}
+	}
+	sort.SliceStable(accepted, func(i, j int) bool {
+		return accepted[i].quality > accepted[j].quality
+	})
+	langs := make([]string, 0, len(accepted))
+	for _, a := range accepted {
+		langs = append(langs, a.lang)
+	}
+	return langs
+}
+
+// collapseNames replaces every Names map in jsonData with a map holding only
+// the name in the first of langs that the entity has a name in, falling back
+// to English. Entities with none of these keep an empty map.
+func collapseNames(jsonData []byte, langs []string) ([]byte, error) {
+	var decoded interface{}
+	err := json.Unmarshal(jsonData, &decoded)
+	if err != nil {
+		return nil, errors.New("unable to decode json for collapsing names: %v", err)
+	}
+	return json.Marshal(collapseNamesIn(decoded, langs))
+}
+
+func collapseNamesIn(value interface{}, langs []string) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if names, isNames := child.(map[string]interface{}); isNames && (key == "Names" || key == "names") {
+				collapsed := make(map[string]interface{}, 1)
+				if lang, found := pickLang(names, langs); found {
+					collapsed[lang] = names[lang]
+				}
+				v[key] = collapsed
+			} else {
+				v[key] = collapseNamesIn(child, langs)
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = collapseNamesIn(child, langs)
+		}
+	}
+	return value
+}
+
+// pickLang finds the key of names for the first of langs that it has a name
+// in, matching case-insensitively and by primary language (so that de-DE
+// matches de), or else English
+func pickLang(names map[string]interface{}, langs []string) (string, bool) {
+	for _, lang := range append(langs, fallbackLang) {
+		primary, _, _ := strings.Cut(lang, "-")
+		for candidate := range names {
+			if strings.EqualFold(candidate, lang) {
+				return candidate, true
+			}
+		}
+		for candidate := range names {
+			if strings.EqualFold(candidate, primary) {
+				return candidate, true
+			}
+		}
+	}
+	return "", false
+}
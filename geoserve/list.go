@@ -0,0 +1,58 @@
+package geoserve
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// listEntry is one line of the NDJSON response for a named list
+type listEntry struct {
+	IP     string          `json:"ip"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// HandleList streams the geolocations of a preconfigured, named list of ips
+// (see WithIPLists) as newline-delimited JSON, one {"ip":...,"result":...}
+// object per ip. basePath is the path at which the containing request handler
+// is registered and is used to extract the list name. With ?aggregate=country,
+// region or continent, it instead answers with the number of ips per country,
+// region or continent.
+func (server *GeoServer) HandleList(resp http.ResponseWriter, req *http.Request, basePath string) {
+	if !server.clientAllowed(req) {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+	name := strings.TrimPrefix(req.URL.Path, basePath)
+	ips, found := server.ipLists[name]
+	if !found {
+		http.NotFound(resp, req)
+		return
+	}
+	if by := req.URL.Query().Get("aggregate"); by != "" {
+		server.writeAggregate(resp, ips, by)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := resp.(http.Flusher)
+	enc := json.NewEncoder(resp)
+	for _, ip := range ips {
+		entry := &listEntry{IP: ip}
+		gr := server.query(get{ip: ip})
+		if gr.res != nil {
+			entry.Result = gr.res.jsonData
+		} else {
+			entry.Error = "lookup failed"
+		}
+		err := enc.Encode(entry)
+		if err != nil {
+			log.Debugf("Unable to stream list %v: %v", name, err)
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
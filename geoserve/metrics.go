@@ -0,0 +1,79 @@
+package geoserve
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lookupDurationBuckets are the upper bounds in seconds of the buckets of the
+// lookup duration histogram
+var lookupDurationBuckets = []float64{0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+
+// metrics tracks the lookup and database update statistics served by
+// HandleMetrics
+type metrics struct {
+	lookups         atomic.Int64
+	cacheHits       atomic.Int64
+	cacheMisses     atomic.Int64
+	sharedCacheHits atomic.Int64
+	updateSuccesses atomic.Int64
+	updateFailures  atomic.Int64
+
+	overloadRejections atomic.Int64
+
+	mx              sync.Mutex
+	durationBuckets []int64 // cumulative counts by lookupDurationBuckets
+	durationSum     float64
+	durationCount   int64
+}
+
+func newMetrics() *metrics {
+	return &metrics{durationBuckets: make([]int64, len(lookupDurationBuckets))}
+}
+
+// observeLookup records a lookup that took duration
+func (m *metrics) observeLookup(duration time.Duration) {
+	m.lookups.Add(1)
+	seconds := duration.Seconds()
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	for i, bound := range lookupDurationBuckets {
+		if seconds <= bound {
+			m.durationBuckets[i]++
+		}
+	}
+	m.durationSum += seconds
+	m.durationCount++
+}
+
+// HandleMetrics serves lookup and database update statistics in the Prometheus
+// text exposition format.
+func (server *GeoServer) HandleMetrics(resp http.ResponseWriter, req *http.Request) {
+	m := server.metrics
+	resp.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	counter := func(name, help string, value int64) {
+		fmt.Fprintf(resp, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+	}
+	counter("geoserve_lookups_total", "Lookups answered from the cache or the database.", m.lookups.Load())
+	counter("geoserve_cache_hits_total", "Lookups answered from the cache.", m.cacheHits.Load())
+	counter("geoserve_cache_misses_total", "Lookups not found in the cache.", m.cacheMisses.Load())
+	counter("geoserve_shared_cache_hits_total", "Lookups not found in the cache but answered from the shared cache.", m.sharedCacheHits.Load())
+	counter("geoserve_db_update_successes_total", "Successful checks for database updates, including finding the database current.", m.updateSuccesses.Load())
+	counter("geoserve_db_update_failures_total", "Failed checks for database updates.", m.updateFailures.Load())
+	counter("geoserve_overload_rejections_total", "Lookups rejected with 503 because too many were in flight.", m.overloadRejections.Load())
+
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	name := "geoserve_lookup_duration_seconds"
+	fmt.Fprintf(resp, "# HELP %s Time taken to answer lookups.\n# TYPE %s histogram\n", name, name)
+	for i, bound := range lookupDurationBuckets {
+		fmt.Fprintf(resp, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), m.durationBuckets[i])
+	}
+	fmt.Fprintf(resp, "%s_bucket{le=\"+Inf\"} %d\n", name, m.durationCount)
+	fmt.Fprintf(resp, "%s_sum %s\n", name, strconv.FormatFloat(m.durationSum, 'g', -1, 64))
+	fmt.Fprintf(resp, "%s_count %d\n", name, m.durationCount)
+}
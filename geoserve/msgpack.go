@@ -0,0 +1,32 @@
+package geoserve
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	errors "github.com/getlantern/errors"
+)
+
+// jsonToMsgpack converts the json response jsonData to MessagePack, so that
+// every response format has a MessagePack equivalent like with jsonToXML.
+// Whole numbers are encoded as integers and map keys are sorted, so that the
+// same response always has the same encoding.
+func jsonToMsgpack(jsonData []byte) ([]byte, error) {
+	var value interface{}
+	err := json.Unmarshal(jsonData, &value)
+	if err != nil {
+		return nil, errors.New("unable to decode json for msgpack: %v", err)
+	}
+	var buf bytes.Buffer
+	encoder := msgpack.NewEncoder(&buf)
+	encoder.UseCompactInts(true)
+	encoder.UseCompactFloats(true)
+	encoder.SetSortMapKeys(true)
+	err = encoder.Encode(value)
+	if err != nil {
+		return nil, errors.New("unable to encode msgpack: %v", err)
+	}
+	return buf.Bytes(), nil
+}
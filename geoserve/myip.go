@@ -0,0 +1,127 @@
+package geoserve
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	errors "github.com/getlantern/errors"
+)
+
+const (
+	// DefaultServerIPTTL is the default time for which the server's public ip
+	// is cached after asking the ip echo service for it
+	DefaultServerIPTTL = 1 * time.Hour
+
+	serverIPTimeout = 5 * time.Second
+)
+
+// serverIP detects the server's own public ip, either configured or as seen by
+// an ip echo service like https://api.ipify.org, which is queried with GET and
+// is expected to respond with just the ip as plain text.
+type serverIP struct {
+	fixed  string
+	url    string
+	ttl    time.Duration
+	client *http.Client
+	clock  clock
+
+	// mx guards ip and expires, and is held while querying the service so
+	// that concurrent requests don't all query it
+	mx      sync.Mutex
+	ip      string
+	expires time.Time
+}
+
+// myIPResponse is the response of HandleMyIP
+type myIPResponse struct {
+	IP          string          `json:"ip"`
+	Geolocation json.RawMessage `json:"geolocation"`
+}
+
+// get returns the server's public ip. If the service can't be reached once
+// the cached ip has expired, the cached ip keeps being used.
+func (sip *serverIP) get() (string, error) {
+	if sip.fixed != "" {
+		return sip.fixed, nil
+	}
+	sip.mx.Lock()
+	defer sip.mx.Unlock()
+	now := sip.clock.Now()
+	if sip.ip != "" && now.Before(sip.expires) {
+		return sip.ip, nil
+	}
+	ip, err := sip.fetch()
+	if err != nil {
+		if sip.ip == "" {
+			return "", err
+		}
+		log.Errorf("Unable to refresh server ip, still using %v: %v", sip.ip, err)
+		return sip.ip, nil
+	}
+	if ip != sip.ip {
+		log.Debugf("Server ip is %v", ip)
+	}
+	sip.ip, sip.expires = ip, now.Add(sip.ttl)
+	return ip, nil
+}
+
+func (sip *serverIP) fetch() (string, error) {
+	resp, err := sip.client.Get(sip.url)
+	if err != nil {
+		return "", errors.New("unable to query ip service: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("unexpected HTTP status %v", resp.Status)
+	}
+	// An ip is short, don't read more than necessary from a misbehaving service
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return "", errors.New("unable to read ip service response: %v", err)
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return "", errors.New("ip service returned invalid ip %q", strings.TrimSpace(string(body)))
+	}
+	return ip.String(), nil
+}
+
+// HandleMyIP geolocates the server's own public ip, as configured or detected
+// with WithServerIP or WithServerIPService, e.g.
+// {"ip":"66.69.242.177","geolocation":{...}}. This differs from a lookup
+// without an ip, which geolocates the client. It answers 404 if neither is
+// configured and 502 if the ip service can't be reached.
+func (server *GeoServer) HandleMyIP(resp http.ResponseWriter, req *http.Request) {
+	if !server.clientAllowed(req) {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if server.serverIP == nil {
+		writeJSONError(resp, http.StatusNotFound, "server ip not configured")
+		return
+	}
+	ip, err := server.serverIP.get()
+	if err != nil {
+		log.Errorf("Unable to determine server ip: %v", err)
+		writeJSONError(resp, http.StatusBadGateway, "unable to determine server ip")
+		return
+	}
+	gr := server.query(get{ip: ip})
+	if gr.res == nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	jsonData, err := json.Marshal(&myIPResponse{IP: ip, Geolocation: gr.res.jsonData})
+	if err != nil {
+		log.Errorf("Unable to encode server ip response: %v", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(jsonData)
+}
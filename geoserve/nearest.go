@@ -0,0 +1,240 @@
+package geoserve
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+
+	errors "github.com/getlantern/errors"
+)
+
+// kmPerDegree is the length of a degree of latitude, or of longitude at the
+// equator
+const kmPerDegree = 2 * math.Pi * earthRadiusKm / 360
+
+// nearestCity is a city in the cityIndex, and the response of HandleNearest
+type nearestCity struct {
+	GeoNameID  uint    `json:"geoname_id"`
+	City       string  `json:"city"`
+	Region     string  `json:"region,omitempty"`
+	Country    string  `json:"country,omitempty"`
+	Latitude   float64 `json:"latitude"`
+	Longitude  float64 `json:"longitude"`
+	DistanceKm float64 `json:"distance_km"`
+}
+
+// cityLocationRecord is decoded for each network when building a cityIndex,
+// and is kept small since there are millions of networks
+type cityLocationRecord struct {
+	City struct {
+		GeoNameID uint `maxminddb:"geoname_id"`
+	} `maxminddb:"city"`
+	Location struct {
+		Latitude  *float64 `maxminddb:"latitude"`
+		Longitude *float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+}
+
+// cityNameRecord is decoded once for each city when building a cityIndex
+type cityNameRecord struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"subdivisions"`
+}
+
+// gridCell is a cell of one degree latitude by one degree longitude
+type gridCell struct {
+	lat, lon int
+}
+
+func gridCellFor(latitude, longitude float64) gridCell {
+	return gridCell{int(math.Floor(latitude)), int(math.Floor(longitude))}
+}
+
+// cityIndex is a spatial index of the cities in a database, for finding the
+// city nearest to given coordinates. Cities are bucketed into gridCells.
+type cityIndex struct {
+	cells  map[gridCell][]*nearestCity
+	cities int
+}
+
+// buildCityIndex indexes the cities of the mmdb file dbData. The database must
+// have City or Enterprise records.
+func buildCityIndex(dbData []byte) (*cityIndex, error) {
+	// Use a separate reader so that the database can be closed while we're
+	// still indexing it
+	reader, err := maxminddb.FromBytes(dbData)
+	if err != nil {
+		return nil, errors.New("unable to open database: %v", err)
+	}
+	defer reader.Close()
+	index := &cityIndex{cells: make(map[gridCell][]*nearestCity)}
+	seen := make(map[uint]bool)
+	networks := reader.Networks()
+	for networks.Next() {
+		var location cityLocationRecord
+		network, err := networks.Network(&location)
+		if err != nil {
+			return nil, errors.New("unable to read network: %v", err)
+		}
+		id := location.City.GeoNameID
+		if id == 0 || seen[id] || location.Location.Latitude == nil || location.Location.Longitude == nil {
+			continue
+		}
+		seen[id] = true
+		var names cityNameRecord
+		err = reader.Lookup(network.IP, &names)
+		if err != nil {
+			return nil, errors.New("unable to read names for %v: %v", network, err)
+		}
+		city := &nearestCity{
+			GeoNameID: id,
+			City:      names.City.Names["en"],
+			Country:   names.Country.IsoCode,
+			Latitude:  *location.Location.Latitude,
+			Longitude: *location.Location.Longitude,
+		}
+		if len(names.Subdivisions) > 0 {
+			city.Region = names.Subdivisions[0].IsoCode
+		}
+		cell := gridCellFor(city.Latitude, city.Longitude)
+		index.cells[cell] = append(index.cells[cell], city)
+		index.cities++
+	}
+	if err := networks.Err(); err != nil {
+		return nil, errors.New("unable to traverse database: %v", err)
+	}
+	return index, nil
+}
+
+// nearest finds the city nearest to the given coordinates, returning nil if
+// the index is empty. It searches rings of cells of growing size around the
+// cell of the coordinates until no city beyond the ring could be nearer than
+// the nearest one found so far.
+func (index *cityIndex) nearest(latitude, longitude float64) *nearestCity {
+	if index.cities == 0 {
+		return nil
+	}
+	center := gridCellFor(latitude, longitude)
+	var best *nearestCity
+	bestKm := math.MaxFloat64
+	// 180 rings around any cell cover the whole globe
+	for r := 0; r <= 180; r++ {
+		for dLat := -r; dLat <= r; dLat++ {
+			for dLon := -r; dLon <= r; dLon++ {
+				if dLat != -r && dLat != r && dLon != -r && dLon != r {
+					// Not on the ring, already searched
+					continue
+				}
+				cell := gridCell{center.lat + dLat, wrapLongitudeCell(center.lon + dLon)}
+				for _, city := range index.cells[cell] {
+					km := haversineKm(latitude, longitude, city.Latitude, city.Longitude)
+					if km < bestKm {
+						best, bestKm = city, km
+					}
+				}
+			}
+		}
+		if best != nil && bestKm <= minKmBeyondRing(latitude, r) {
+			break
+		}
+	}
+	result := *best
+	result.DistanceKm = math.Round(bestKm*10) / 10
+	return &result
+}
+
+// wrapLongitudeCell wraps the longitude of a cell into [-180, 180)
+func wrapLongitudeCell(lon int) int {
+	return ((lon+180)%360+360)%360 - 180
+}
+
+// minKmBeyondRing is a lower bound for the distance from a point at the given
+// latitude to any point outside of ring r around its cell. Such points are at
+// least r degrees of latitude or r degrees of longitude away. In the latter
+// case, they're no closer than the meridian r degrees away, whose distance is
+// given by the spherical law of sines.
+func minKmBeyondRing(latitude float64, r int) float64 {
+	toRadians := func(degrees float64) float64 { return degrees * math.Pi / 180 }
+	latitudeKm := float64(r) * kmPerDegree
+	longitudeKm := earthRadiusKm * math.Asin(math.Cos(toRadians(latitude))*math.Sin(toRadians(math.Min(float64(r), 90))))
+	return math.Min(latitudeKm, longitudeKm)
+}
+
+// indexCities builds the cityIndex for db in the background, if enabled with
+// WithNearestCity. The index only replaces the current one if db is still the
+// live database once it's built.
+func (server *GeoServer) indexCities(db *database) {
+	if !server.nearestCity {
+		return
+	}
+	go func() {
+		start := time.Now()
+		index, err := buildCityIndex(db.data)
+		if err != nil {
+			log.Errorf("Unable to index cities: %v", err)
+			return
+		}
+		server.dbMx.RLock()
+		live := server.db == db
+		if live {
+			server.cities.Store(index)
+		}
+		server.dbMx.RUnlock()
+		if live {
+			log.Debugf("Indexed %d cities in %v", index.cities, time.Since(start))
+		}
+	}()
+}
+
+// HandleNearest answers with the city nearest to the lat and lon query
+// parameters, e.g. /nearest?lat=30.26&lon=-97.74 returns
+// {"geoname_id":4671654,"city":"Austin","region":"TX","country":"US","latitude":30.2672,"longitude":-97.7431,"distance_km":0.7}.
+// It answers 400 for invalid coordinates, 404 if the database has no cities
+// and 503 until the cities of the database have been indexed, which happens
+// in the background when the database is loaded (see WithNearestCity).
+func (server *GeoServer) HandleNearest(resp http.ResponseWriter, req *http.Request) {
+	if !server.clientAllowed(req) {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+	query := req.URL.Query()
+	latitude, err := strconv.ParseFloat(query.Get("lat"), 64)
+	if err != nil || latitude < -90 || latitude > 90 {
+		writeJSONError(resp, http.StatusBadRequest, "lat must be a latitude between -90 and 90")
+		return
+	}
+	longitude, err := strconv.ParseFloat(query.Get("lon"), 64)
+	if err != nil || longitude < -180 || longitude > 180 {
+		writeJSONError(resp, http.StatusBadRequest, "lon must be a longitude between -180 and 180")
+		return
+	}
+	index := server.cities.Load()
+	if index == nil {
+		writeJSONError(resp, http.StatusServiceUnavailable, "cities not indexed yet")
+		return
+	}
+	city := index.nearest(latitude, longitude)
+	if city == nil {
+		writeJSONError(resp, http.StatusNotFound, "no cities in database")
+		return
+	}
+	jsonData, err := json.Marshal(city)
+	if err != nil {
+		log.Errorf("Unable to encode nearest city: %v", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(jsonData)
+}
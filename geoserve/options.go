@@ -0,0 +1,408 @@
+package geoserve
+
+import (
+	"strings"
+	"time"
+)
+
+// Option configures optional behavior of a GeoServer.
+type Option func(server *GeoServer)
+
+// WithOverrideURL configures an override service that is consulted before
+// the MaxMind database for all lookups except fresh ones. Overrides are shaped
+// like the lookup asked for, e.g. reduced to the country for country lookups.
+// See overrideClient for the protocol.
+func WithOverrideURL(url string) Option {
+	return func(server *GeoServer) {
+		server.overrideURL = url
+	}
+}
+
+// WithSharedCache consults cache for results that aren't in the server's own
+// cache before going to the database, and adds the results of database
+// lookups to it, for example to share results between servers with a cache
+// backed by Redis. The server's own cache is still used in front of it, so
+// disable that with a cache size of 0 to rely on cache alone.
+func WithSharedCache(cache Cache) Option {
+	return func(server *GeoServer) {
+		server.sharedCache = cache
+	}
+}
+
+// WithFetcher fetches databases from URLs of the given scheme with fetcher,
+// replacing the built-in Fetcher for the scheme if there is one. The built-in
+// schemes are http, https, file, s3 and gs.
+func WithFetcher(scheme string, fetcher Fetcher) Option {
+	return func(server *GeoServer) {
+		server.fetchers[strings.ToLower(scheme)] = fetcher
+	}
+}
+
+// WithServerIP enables HandleMyIP, configuring the server's public ip, e.g.
+// when it's known from the deployment. It takes precedence over
+// WithServerIPService.
+func WithServerIP(ip string) Option {
+	return func(server *GeoServer) {
+		server.serverIPAddr = ip
+	}
+}
+
+// WithServerIPService enables HandleMyIP, detecting the server's public ip
+// with the ip echo service at url (e.g. https://api.ipify.org), which must
+// respond with just the ip as plain text. The ip is cached for ttl (default
+// DefaultServerIPTTL).
+func WithServerIPService(url string, ttl time.Duration) Option {
+	return func(server *GeoServer) {
+		server.serverIPURL = url
+		if ttl > 0 {
+			server.serverIPTTL = ttl
+		}
+	}
+}
+
+// WithMaxPathLength limits the length of the request path beyond the base
+// path. Longer requests are rejected with 414. 0 disables the limit.
+func WithMaxPathLength(maxPathLength int) Option {
+	return func(server *GeoServer) {
+		server.maxPathLength = maxPathLength
+	}
+}
+
+// WithNearestCity enables HandleNearest by indexing the cities of each
+// database in the background when it's loaded. This takes a few seconds and
+// some memory for the full city database.
+func WithNearestCity() Option {
+	return func(server *GeoServer) {
+		server.nearestCity = true
+	}
+}
+
+// WithLookupTimeout limits how long Handle waits for a lookup before giving up
+// with 503, or until the client goes away if that's sooner. 0 disables the
+// limit.
+func WithLookupTimeout(timeout time.Duration) Option {
+	return func(server *GeoServer) {
+		server.lookupTimeout = timeout
+	}
+}
+
+// WithMaxCIDRAddresses limits the number of addresses in the ranges that
+// HandleCIDR geolocates. Larger ranges are rejected with 400.
+func WithMaxCIDRAddresses(maxAddresses uint64) Option {
+	return func(server *GeoServer) {
+		server.maxCIDRAddresses = maxAddresses
+	}
+}
+
+// WithEditionFile loads an additional database edition from the uncompressed
+// dbFile. The edition is determined from the database's metadata, and each
+// edition may only be loaded once. Unlike the main database, additional
+// editions are not updated automatically.
+func WithEditionFile(dbFile string) Option {
+	return func(server *GeoServer) {
+		server.editionFiles = append(server.editionFiles, dbFile)
+	}
+}
+
+// WithStaleOnError keeps a secondary cache of the last successful lookups that
+// survives database updates. When a lookup fails, for example because a bad
+// database was loaded, the last good result is served with "stale":true.
+func WithStaleOnError() Option {
+	return func(server *GeoServer) {
+		server.staleOnError = true
+	}
+}
+
+// WithRequestLogging logs a line for each lookup handled by Handle with the
+// client ip, looked up ip, country code, whether it was a cache hit, the
+// response status and the latency.
+func WithRequestLogging() Option {
+	return func(server *GeoServer) {
+		server.logRequests = true
+	}
+}
+
+// WithIPLists configures named lists of ips that can be geolocated in one go
+// with HandleList.
+func WithIPLists(lists map[string][]string) Option {
+	return func(server *GeoServer) {
+		server.ipLists = lists
+	}
+}
+
+// WithPrivateIPStatus answers lookups of private, reserved and invalid ips with
+// the given HTTP status and a {"ip":...,"category":...} body instead of looking
+// them up. 0 (the default) looks them up like any other ip. Statuses other
+// than 200-599, which can't be sent as a final response, are logged and
+// ignored.
+func WithPrivateIPStatus(status int) Option {
+	return func(server *GeoServer) {
+		if status != 0 && (status < 200 || status > 599) {
+			log.Errorf("Ignoring invalid status %d for private ips", status)
+			return
+		}
+		server.privateIPStatus = status
+	}
+}
+
+// WithCachePolicy selects the eviction policy of the result cache, either
+// CachePolicyLRU (the default) or CachePolicyLFU. LFU keeps regularly queried
+// ips cached through bursts of one-off lookups.
+func WithCachePolicy(policy string) Option {
+	return func(server *GeoServer) {
+		server.cachePolicy = policy
+	}
+}
+
+// WithLoadShedding protects the database from the burst of cache misses that
+// follows a database update. For window after each update, whenever more than
+// maxInFlight lookups are in progress, the given fraction of new requests is
+// answered with 429 and a jittered Retry-After.
+func WithLoadShedding(window time.Duration, maxInFlight int, fraction float64) Option {
+	return func(server *GeoServer) {
+		server.shedding = &loadShedding{window, int64(maxInFlight), fraction}
+	}
+}
+
+// WithMaxInFlight caps the number of lookups in progress at once. Requests
+// that would exceed it are answered right away with 503 and a Retry-After,
+// rather than piling up behind lookups that may then time out. Such
+// rejections are counted by HandleMetrics. Lookups given up on after
+// WithLookupTimeout count until they're actually over. 0 (the default) means
+// no limit.
+func WithMaxInFlight(maxInFlight int) Option {
+	return func(server *GeoServer) {
+		server.maxInFlight = int64(maxInFlight)
+	}
+}
+
+// WithDefaultCacheSize sets the capacity of the caches for modes without a
+// size of their own (default CacheSize). A size of 0 disables caching, so that
+// every lookup goes to the database.
+func WithDefaultCacheSize(size int) Option {
+	return func(server *GeoServer) {
+		server.defaultCacheSize = size
+	}
+}
+
+// WithCacheTTL treats cached results older than ttl as missing, bounding how
+// stale they can get regardless of database updates. 0 (the default) keeps
+// them until they're evicted or the database is updated.
+func WithCacheTTL(ttl time.Duration) Option {
+	return func(server *GeoServer) {
+		server.cacheTTL = ttl
+	}
+}
+
+// WithNegativeCacheTTL treats cached results for ips that the database has no
+// data for as missing once they're older than ttl. Such results are cached
+// like any other so that repeated lookups of unknown ips, as from scanners,
+// don't all go to the database, but ttl lets them expire sooner than the
+// cache TTL (see WithCacheTTL). Failed lookups are never cached. 0 (the
+// default) treats them like other results.
+func WithNegativeCacheTTL(ttl time.Duration) Option {
+	return func(server *GeoServer) {
+		server.negativeCacheTTL = ttl
+	}
+}
+
+// WithCacheMaxAge lets clients and shared caches like CDNs cache lookup
+// results for maxAge by setting the Cache-Control header of Handle's
+// responses. Lookups of the client's own ip are marked private so that shared
+// caches don't serve them to other clients. 0 (the default) sets no header.
+func WithCacheMaxAge(maxAge time.Duration) Option {
+	return func(server *GeoServer) {
+		server.cacheMaxAge = maxAge
+	}
+}
+
+// WithCacheSize sets the capacity of the cache for the given mode (one of
+// CacheModeCity, CacheModeCountry, CacheModeRaw, CacheModeBrief or
+// CacheModeTimezone). A size of 0 disables caching for the mode. Modes without
+// a configured size use the default size, see WithDefaultCacheSize.
+func WithCacheSize(mode string, size int) Option {
+	return func(server *GeoServer) {
+		if server.cacheSizes == nil {
+			server.cacheSizes = make(map[string]int)
+		}
+		server.cacheSizes[mode] = size
+	}
+}
+
+// WithDefaultLang collapses the Names maps in all responses to just the name in
+// lang, unless a request asks for another language with ?lang= or
+// Accept-Language, or for every language with ?lang=all.
+func WithDefaultLang(lang string) Option {
+	return func(server *GeoServer) {
+		server.defaultLang = lang
+	}
+}
+
+// WithDefaultCase re-keys all responses using keyCase (CaseCamel, CaseSnake or
+// CasePascal) unless a request asks for a different one with ?case=. Passing
+// ?case= with no value keeps the keys as they are.
+func WithDefaultCase(keyCase string) Option {
+	return func(server *GeoServer) {
+		server.defaultCase = keyCase
+	}
+}
+
+// WithExplicitUnknown answers lookups of ips that the database has no data for
+// with {"found":false,"ip":...} rather than a record of zero values.
+func WithExplicitUnknown() Option {
+	return func(server *GeoServer) {
+		server.explicitUnknown = true
+	}
+}
+
+// WithoutReflectedIP omits the X-Reflected-Ip header, which otherwise tells
+// clients which ip Handle looked up, including their own.
+func WithoutReflectedIP() Option {
+	return func(server *GeoServer) {
+		server.reflectIP = false
+	}
+}
+
+// WithAllowedClientCIDRs restricts the server to clients whose ip is within
+// one of the given CIDR ranges. Other clients are answered with 403.
+func WithAllowedClientCIDRs(cidrs []string) Option {
+	return func(server *GeoServer) {
+		server.allowedClientCIDRs = cidrs
+	}
+}
+
+// WithTrustedProxies honors the X-Forwarded-For header of requests from
+// proxies whose ip is within one of the given CIDR ranges, see ClientIP.
+func WithTrustedProxies(cidrs []string) Option {
+	return func(server *GeoServer) {
+		server.trustedProxyCIDRs = cidrs
+	}
+}
+
+// WithConfidenceWeights configures how the factors of the confidence score are
+// weighted, see ConfidenceWeights.
+func WithConfidenceWeights(weights ConfidenceWeights) Option {
+	return func(server *GeoServer) {
+		server.confidenceWeights = weights
+	}
+}
+
+// WithDBFileRetry makes up to attempts attempts to read the initial database
+// file, waiting interval between them, so that a file on a volume that's
+// mounted shortly after startup can still be loaded.
+func WithDBFileRetry(attempts int, interval time.Duration) Option {
+	return func(server *GeoServer) {
+		server.dbFileAttempts = attempts
+		server.dbFileRetryInterval = interval
+	}
+}
+
+// WithDBWait makes NewServer wait up to timeout for the database to be
+// downloaded when it's given a URL rather than a file, so that lookups work as
+// soon as it returns. If there's still no database by then, NewServer fails.
+// A database persisted with WithDBCacheDir counts, so doesn't need to be
+// downloaded again. 0 (the default) doesn't wait.
+func WithDBWait(timeout time.Duration) Option {
+	return func(server *GeoServer) {
+		server.dbWaitTimeout = timeout
+	}
+}
+
+// WithDBRefresh sets how often the database URL is checked for a new version
+// of the database, and how soon it's checked again after a failed check.
+func WithDBRefresh(refreshInterval, retryInterval time.Duration) Option {
+	return func(server *GeoServer) {
+		server.dbRefreshInterval = refreshInterval
+		server.dbRetryInterval = retryInterval
+	}
+}
+
+// WithDBType sets the type of database downloaded from the database URL, e.g.
+// GeoIP2-Enterprise or GeoIP2-ISP. Archives are searched for a <dbType>.mmdb
+// file, and databases of any other type are rejected. Lookups return all of
+// the fields that the database type provides.
+func WithDBType(dbType string) Option {
+	return func(server *GeoServer) {
+		server.expectedDBType = dbType
+	}
+}
+
+// WithFallbackDB serves the database in file while there's no downloaded
+// database yet, so that a server given a database URL can answer lookups as
+// soon as it starts and keeps answering them if the download keeps failing.
+// The downloaded database replaces it as soon as it's available, regardless of
+// which is newer. A database persisted with WithDBCacheDir is preferred over
+// the fallback.
+func WithFallbackDB(file string) Option {
+	return func(server *GeoServer) {
+		server.fallbackDBFile = file
+	}
+}
+
+// WithDBCacheDir saves each database downloaded from the database URL to dir,
+// and starts from the saved database on the next start rather than
+// downloading it again, unless there's a newer one.
+func WithDBCacheDir(dir string) Option {
+	return func(server *GeoServer) {
+		server.dbCacheDir = dir
+	}
+}
+
+// WithDBURLs downloads additional databases alongside the main one, by type
+// (e.g. GeoIP2-Anonymous-IP) from their URLs. Each of them is kept current on
+// its own goroutine, checking as often as for the main database. The main
+// database's URL is the one given to NewServer.
+func WithDBURLs(urls map[string]string) Option {
+	return func(server *GeoServer) {
+		for dbType, url := range urls {
+			aux := server.auxiliaryDbFor(dbType)
+			aux.file, aux.url = "", url
+		}
+	}
+}
+
+// WithAnonymousDB enables HandleAnonymous with the GeoIP2-Anonymous-IP
+// database read from dbFile, or if dbFile is "", downloaded from dbURL and
+// kept current like the main database.
+func WithAnonymousDB(dbFile, dbURL string) Option {
+	return func(server *GeoServer) {
+		aux := server.auxiliaryDbFor(anonymousDBType)
+		aux.file = dbFile
+		if dbFile == "" {
+			aux.url = dbURL
+		}
+	}
+}
+
+// WithMaxUpdateAge sets how long after the database was last updated or
+// confirmed current HandleHealth starts reporting the server as unhealthy. 0
+// disables the check. It only applies to servers that download updates.
+func WithMaxUpdateAge(maxUpdateAge time.Duration) Option {
+	return func(server *GeoServer) {
+		server.maxUpdateAge = maxUpdateAge
+	}
+}
+
+// WithCacheChurnInterval periodically logs and records how many entries of
+// each cache were added and evicted during the interval, see CacheChurn.
+func WithCacheChurnInterval(interval time.Duration) Option {
+	return func(server *GeoServer) {
+		server.churnInterval = interval
+	}
+}
+
+// WithCacheAutoTune periodically resizes the caches to reach a target hit rate
+// within a memory ceiling, see CacheAutoTune. Configured cache sizes are used
+// as the starting sizes.
+func WithCacheAutoTune(autoTune CacheAutoTune) Option {
+	return func(server *GeoServer) {
+		server.autoTune = &autoTune
+	}
+}
+
+// withClock replaces the real clock, for use in tests.
+func withClock(c clock) Option {
+	return func(server *GeoServer) {
+		server.clock = c
+	}
+}
@@ -0,0 +1,212 @@
+package geoserve
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/groupcache/lru"
+	geoip2 "github.com/oschwald/geoip2-golang"
+
+	errors "github.com/getlantern/errors"
+)
+
+const (
+	overrideTimeout   = 2 * time.Second
+	overrideCacheTTL  = 5 * time.Minute
+	overrideCacheSize = 10000
+
+	// overrideFailureBackoff is how long the service isn't consulted after
+	// failing, so that an outage doesn't slow down every lookup by up to
+	// overrideTimeout
+	overrideFailureBackoff = 30 * time.Second
+)
+
+// overrideClient consults an external override service for locations. The
+// service is queried with GET <url>/<ip> and is expected to respond with 200
+// and a JSON location (same shape as our own responses) if it has an override
+// for the ip, or 404 if it doesn't.
+type overrideClient struct {
+	url    string
+	client *http.Client
+	clock  clock
+
+	// mx guards cache and unavailableUntil, the time until which the service
+	// is skipped after a failure
+	mx               sync.Mutex
+	cache            *lru.Cache
+	unavailableUntil time.Time
+}
+
+// overrideEntry is a cached answer from the override service
+type overrideEntry struct {
+	res     *result // nil if the service has no override for the ip
+	expires time.Time
+}
+
+func newOverrideClient(url string, c clock) *overrideClient {
+	return &overrideClient{
+		url:    strings.TrimSuffix(url, "/"),
+		client: &http.Client{Timeout: overrideTimeout},
+		clock:  c,
+		cache:  lru.New(overrideCacheSize),
+	}
+}
+
+// lookup returns the overridden location for ip, or nil if the service doesn't
+// have one. Failures to reach the service are logged and treated as no
+// override so that they don't break normal lookups. After a failure, the
+// service isn't consulted for overrideFailureBackoff.
+func (oc *overrideClient) lookup(ip string) *result {
+	now := oc.clock.Now()
+	oc.mx.Lock()
+	cached, found := oc.cache.Get(ip)
+	unavailable := now.Before(oc.unavailableUntil)
+	oc.mx.Unlock()
+	if found {
+		entry := cached.(*overrideEntry)
+		if now.Before(entry.expires) {
+			return entry.res
+		}
+	}
+	if unavailable {
+		return nil
+	}
+
+	res, err := oc.fetch(ip)
+	if err != nil {
+		log.Errorf("Unable to consult override service for %v, skipping it for %v: %v", ip, overrideFailureBackoff, err)
+		oc.mx.Lock()
+		oc.unavailableUntil = now.Add(overrideFailureBackoff)
+		oc.mx.Unlock()
+		return nil
+	}
+	oc.mx.Lock()
+	oc.cache.Add(ip, &overrideEntry{res, now.Add(overrideCacheTTL)})
+	oc.mx.Unlock()
+	return res
+}
+
+func (oc *overrideClient) fetch(ip string) (*result, error) {
+	resp, err := oc.client.Get(oc.url + "/" + url.PathEscape(ip))
+	if err != nil {
+		return nil, errors.New("unable to query override service: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("unexpected HTTP status %v", resp.Status)
+	}
+	jsonData, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.New("unable to read override response: %v", err)
+	}
+	record := &geoip2.City{}
+	err = json.Unmarshal(jsonData, record)
+	if err != nil {
+		return nil, errors.New("override service returned invalid json: %v", err)
+	}
+	return &result{record: record, jsonData: jsonData, source: "override"}, nil
+}
+
+// shapeOverride shapes res, a location from the override service, like the
+// result of lookup g in db, so that overrides honor the mode of the lookup and
+// the record type of the edition answering it. It returns nil if db doesn't
+// hold locations.
+func shapeOverride(db *database, g get, res *result) (*result, error) {
+	var record interface{} = &geoip2.City{}
+	if db != nil {
+		record = newFullRecord(db)
+	}
+	switch record.(type) {
+	case *geoip2.City, *geoip2.Enterprise:
+	default:
+		return nil, nil
+	}
+	switch {
+	case g.brief:
+		return toBrief(res)
+	case g.timezone:
+		return toTimezone(g.ip, res)
+	case g.raw:
+		// Keyed like the database record rather than like our responses
+		raw, _ := rawValueOf(reflect.ValueOf(res.record))
+		record, _ := raw.(map[string]interface{})
+		if record == nil {
+			record = make(map[string]interface{})
+		}
+		jsonData, err := json.Marshal(record)
+		if err != nil {
+			return nil, errors.New("unable to encode raw override: %v", err)
+		}
+		return &result{record: record, jsonData: jsonData, source: res.source, empty: len(record) == 0}, nil
+	}
+	if g.country {
+		record = &geoip2.Country{}
+	}
+	// Our responses for these types share their field names
+	err := json.Unmarshal(res.jsonData, record)
+	if err != nil {
+		return nil, errors.New("unable to convert override: %v", err)
+	}
+	jsonData, err := json.Marshal(record)
+	if err != nil {
+		return nil, errors.New("unable to encode override: %v", err)
+	}
+	return &result{record: record, jsonData: jsonData, source: res.source, empty: isEmptyRecord(record)}, nil
+}
+
+// rawValueOf converts v, part of a geoip2 record, to what a raw lookup decodes
+// for it, with structs as maps keyed by their maxminddb field names. Empty
+// values are left out, like they're left out of the database, in which case it
+// returns false.
+func rawValueOf(v reflect.Value) (interface{}, bool) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil, false
+		}
+		return rawValueOf(v.Elem())
+	case reflect.Struct:
+		m := make(map[string]interface{})
+		for i := 0; i < v.NumField(); i++ {
+			name := v.Type().Field(i).Tag.Get("maxminddb")
+			if name == "" || name == "-" {
+				continue
+			}
+			if value, ok := rawValueOf(v.Field(i)); ok {
+				m[name] = value
+			}
+		}
+		return m, len(m) > 0
+	case reflect.Map:
+		m := make(map[string]interface{}, v.Len())
+		for iter := v.MapRange(); iter.Next(); {
+			if value, ok := rawValueOf(iter.Value()); ok {
+				m[fmt.Sprint(iter.Key().Interface())] = value
+			}
+		}
+		return m, len(m) > 0
+	case reflect.Slice:
+		s := make([]interface{}, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			if value, ok := rawValueOf(v.Index(i)); ok {
+				s = append(s, value)
+			}
+		}
+		return s, len(s) > 0
+	default:
+		if v.IsZero() {
+			return nil, false
+		}
+		return v.Interface(), true
+	}
+}
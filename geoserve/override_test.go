@@ -0,0 +1,85 @@
+package geoserve
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOverrideBacksOffAfterFailure(t *testing.T) {
+	var failing, requests int32 = 1, 0
+	service := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			resp.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		resp.Write([]byte(`{"City":{"Names":{"en":"Override"}}}`))
+	}))
+	defer service.Close()
+	clock := newFakeClock()
+	oc := newOverrideClient(service.URL, clock)
+
+	assert.Nil(t, oc.lookup(testIP))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&requests))
+	// Other ips don't wait on the failing service either
+	assert.Nil(t, oc.lookup(testClientIP))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&requests), "service should be skipped after failing")
+
+	atomic.StoreInt32(&failing, 0)
+	clock.advance(overrideFailureBackoff)
+	res := oc.lookup(testIP)
+	require.NotNil(t, res)
+	assert.Equal(t, "override", res.source)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&requests))
+
+	// Successful answers are still cached
+	clock.advance(time.Minute)
+	assert.NotNil(t, oc.lookup(testIP))
+	assert.EqualValues(t, 2, atomic.LoadInt32(&requests))
+}
+
+func TestOverridesHonorLookupMode(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/"+testIP {
+			http.NotFound(resp, req)
+			return
+		}
+		resp.Write([]byte(`{"City":{"Names":{"en":"Override"}},"Country":{"IsoCode":"FR"},"Location":{"TimeZone":"Europe/Paris"}}`))
+	}))
+	defer service.Close()
+	server := newTestServer(t, WithOverrideURL(service.URL))
+
+	for path, expected := range map[string][]string{
+		"/lookup/" + testIP:                 {`"Override"`, `"FR"`},
+		"/lookup/country/" + testIP:         {`"FR"`},
+		"/lookup/raw/" + testIP:             {`"city":{"names":{"en":"Override"}}`, `"iso_code":"FR"`},
+		"/lookup/" + testIP + "?mode=brief": {`{"country":"FR","region":"","city":"Override"}`},
+		"/lookup/timezone/" + testIP:        {`"Europe/Paris"`},
+		"/lookup/" + testClientIP:           {`"United Kingdom"`},
+		"/lookup/country/" + testClientIP:   {`"GB"`},
+	} {
+		resp := httptest.NewRecorder()
+		server.Handle(resp, httptest.NewRequest(http.MethodGet, path, nil), "/lookup/", "")
+		require.Equal(t, http.StatusOK, resp.Code, path)
+		for _, e := range expected {
+			assert.Contains(t, resp.Body.String(), e, path)
+		}
+		if strings.HasPrefix(path, "/lookup/country/") {
+			assert.NotContains(t, resp.Body.String(), "Override", "country lookups don't have cities")
+		}
+	}
+
+	// Other ways of looking up ips go through the override too
+	city, err := server.Lookup(testIP)
+	require.NoError(t, err)
+	assert.Equal(t, "Override", city.City.Names["en"])
+	resp := postBatch(server, `["`+testIP+`"]`)
+	assert.Contains(t, resp.Body.String(), "Override")
+}
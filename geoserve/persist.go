@@ -0,0 +1,67 @@
+package geoserve
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	errors "github.com/getlantern/errors"
+)
+
+// persistedDbFile is the name of the downloaded database within the database
+// cache directory
+const persistedDbFile = "geoserve.mmdb"
+
+// persistedDbPath returns the path of the downloaded database in the database
+// cache directory, or "" if downloads aren't persisted
+func (server *GeoServer) persistedDbPath() string {
+	if server.dbCacheDir == "" {
+		return ""
+	}
+	return filepath.Join(server.dbCacheDir, persistedDbFile)
+}
+
+// readPersistedDb reads the database persisted by a previous run, if any. It
+// returns a nil database if there is none.
+func (server *GeoServer) readPersistedDb() (*database, time.Time, error) {
+	path := server.persistedDbPath()
+	if path == "" {
+		return nil, time.Time{}, nil
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, time.Time{}, nil
+	}
+	return server.readDbFromFile(path)
+}
+
+// persistDb writes the raw contents of the downloaded db to the database cache
+// directory, with lastModified as its modification time so that the next run
+// only downloads a newer database. The file is replaced atomically so that a
+// crash never leaves a partial database behind.
+func (server *GeoServer) persistDb(db *database, lastModified time.Time) error {
+	path := server.persistedDbPath()
+	if path == "" {
+		return nil
+	}
+	tmp, err := os.CreateTemp(server.dbCacheDir, persistedDbFile+".*")
+	if err != nil {
+		return errors.New("unable to create file in %v: %v", server.dbCacheDir, err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(db.data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.New("unable to write %v: %v", tmp.Name(), err)
+	}
+	err = os.Chtimes(tmp.Name(), lastModified, lastModified)
+	if err != nil {
+		return errors.New("unable to set modification time of %v: %v", tmp.Name(), err)
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return errors.New("unable to rename %v to %v: %v", tmp.Name(), path, err)
+	}
+	return nil
+}
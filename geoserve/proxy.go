@@ -0,0 +1,57 @@
+package geoserve
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ClientIP returns the ip of the client making req. Unless req comes from a
+// trusted proxy (see WithTrustedProxies), that's the remote address. Otherwise,
+// the X-Forwarded-For chain is walked from the right, skipping the addresses of
+// trusted proxies, and the first untrusted address is the client. This way,
+// clients can't fake their ip by sending their own X-Forwarded-For.
+func (server *GeoServer) ClientIP(req *http.Request) string {
+	return clientIpFor(req, server.trustedProxies)
+}
+
+// clientIpFor returns the ip of the client making req, honoring the
+// X-Forwarded-For header of the trustedProxies
+func clientIpFor(req *http.Request, trustedProxies []*net.IPNet) string {
+	clientIp, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		// No port
+		clientIp = req.RemoteAddr
+	}
+	if !isTrustedProxy(clientIp, trustedProxies) {
+		return clientIp
+	}
+	// There may be multiple headers, each with a comma-separated list of the
+	// hops so far, with the most recent last
+	hops := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		clientIp = hop
+		if !isTrustedProxy(hop, trustedProxies) {
+			break
+		}
+	}
+	return clientIp
+}
+
+// isTrustedProxy determines whether ip is within one of the trustedProxies
+func isTrustedProxy(ip string, trustedProxies []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range trustedProxies {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package geoserve
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIpFor(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	trustedProxies := []*net.IPNet{trusted}
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		expectedIP   string
+	}{
+		{"IPv4 with port", "81.2.69.142:51234", nil, "81.2.69.142"},
+		{"bracketed IPv6 with port", "[2001:db8::1]:51234", nil, "2001:db8::1"},
+		{"IPv4 without port", "81.2.69.142", nil, "81.2.69.142"},
+		{"IPv6 without port", "2001:db8::1", nil, "2001:db8::1"},
+		{"untrusted proxy", "81.2.69.142:51234", []string{"2.125.160.216"}, "81.2.69.142"},
+		{"trusted proxy", "10.0.0.1:51234", []string{"2.125.160.216"}, "2.125.160.216"},
+		{"chain of trusted proxies", "10.0.0.1:51234", []string{"2.125.160.216, 10.0.0.2", "10.0.0.3"}, "2.125.160.216"},
+		{"faked hop before client", "10.0.0.1:51234", []string{"1.2.3.4, 2.125.160.216, 10.0.0.2"}, "2.125.160.216"},
+		{"only trusted proxies", "10.0.0.1:51234", []string{"10.0.0.2"}, "10.0.0.2"},
+		{"trusted proxy without header", "10.0.0.1:51234", nil, "10.0.0.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := &http.Request{RemoteAddr: test.remoteAddr, Header: make(http.Header)}
+			for _, value := range test.forwardedFor {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			assert.Equal(t, test.expectedIP, clientIpFor(req, trustedProxies))
+		})
+	}
+}
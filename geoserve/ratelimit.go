@@ -0,0 +1,101 @@
+package geoserve
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitPruneInterval is how often the buckets of clients that have stopped
+// making requests are discarded
+const rateLimitPruneInterval = 1 * time.Minute
+
+// RateLimiter limits the rate of requests from each client ip with a token
+// bucket per ip. Buckets hold up to burst tokens and are refilled at
+// ratePerSecond tokens per second, and each request takes one token.
+type RateLimiter struct {
+	ratePerSecond float64
+	burst         float64
+	clientIP      func(*http.Request) string
+
+	mx        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// NewRateLimiter constructs a RateLimiter allowing ratePerSecond requests per
+// second from each client ip, with bursts of up to burst requests. If burst is
+// less than 1, it defaults to ratePerSecond rounded up. clientIP identifies the
+// client making a request, typically GeoServer.ClientIP. If it's nil, clients
+// are identified by their remote address.
+func NewRateLimiter(ratePerSecond float64, burst int, clientIP func(*http.Request) string) *RateLimiter {
+	if burst < 1 {
+		burst = int(math.Ceil(ratePerSecond))
+	}
+	if clientIP == nil {
+		clientIP = func(req *http.Request) string { return clientIpFor(req, nil) }
+	}
+	return &RateLimiter{
+		ratePerSecond: ratePerSecond,
+		burst:         float64(burst),
+		clientIP:      clientIP,
+		buckets:       make(map[string]*tokenBucket),
+		lastPrune:     time.Now(),
+	}
+}
+
+// Limit wraps handler so that clients exceeding the rate limit get 429, with
+// a Retry-After header giving the number of seconds until their next request
+// would be allowed. The limits are shared by all handlers wrapped by the same
+// RateLimiter.
+func (l *RateLimiter) Limit(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		wait := l.take(l.clientIP(req), time.Now())
+		if wait > 0 {
+			resp.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(resp, "Rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		handler.ServeHTTP(resp, req)
+	})
+}
+
+// take takes a token from the bucket for ip, returning 0 if there was one or
+// otherwise how long until there will be
+func (l *RateLimiter) take(ip string, now time.Time) time.Duration {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	if now.Sub(l.lastPrune) > rateLimitPruneInterval {
+		l.prune(now)
+	}
+	bucket := l.buckets[ip]
+	if bucket == nil {
+		bucket = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[ip] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*l.ratePerSecond)
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		return time.Duration((1 - bucket.tokens) / l.ratePerSecond * float64(time.Second))
+	}
+	bucket.tokens--
+	return 0
+}
+
+// prune discards the buckets that would have refilled by now, since they're
+// the same as new buckets
+func (l *RateLimiter) prune(now time.Time) {
+	for ip, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*l.ratePerSecond >= l.burst {
+			delete(l.buckets, ip)
+		}
+	}
+	l.lastPrune = now
+}
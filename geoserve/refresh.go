@@ -0,0 +1,74 @@
+package geoserve
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/getlantern/hidden"
+)
+
+// refreshResult is the outcome of a refresh requested from keepDbCurrent
+type refreshResult struct {
+	lastModified time.Time
+	err          error
+}
+
+// refreshResponse is the response of HandleRefresh
+type refreshResponse struct {
+	Applied      bool       `json:"applied"`
+	LastModified *time.Time `json:"last_modified,omitempty"`
+}
+
+// HandleRefresh checks the database URL for a new database right away rather
+// than at the next scheduled check, which is rescheduled from now. POST to it
+// to answer with whether a new database was applied, e.g.
+// {"applied":true,"last_modified":"2024-01-02T00:00:00Z"}, or
+// {"applied":false} if the database hasn't changed. It answers 502 if the
+// check fails and 409 if the database isn't downloaded, so can't be refreshed.
+// This should only be served behind RequireAdmin.
+func (server *GeoServer) HandleRefresh(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		resp.Header().Set("Allow", http.MethodPost)
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if server.dbRefresh == nil {
+		writeJSONError(resp, http.StatusConflict, "database isn't downloaded from a URL")
+		return
+	}
+	refreshed := make(chan refreshResult, 1)
+	select {
+	case server.dbRefresh <- refreshed:
+	case <-server.done:
+		writeJSONError(resp, http.StatusServiceUnavailable, errClosed.Error())
+		return
+	case <-req.Context().Done():
+		return
+	}
+	var result refreshResult
+	select {
+	case result = <-refreshed:
+	case <-req.Context().Done():
+		return
+	}
+	r := &refreshResponse{}
+	switch result.err {
+	case nil:
+		r.Applied = true
+		lastModified := result.lastModified.UTC()
+		r.LastModified = &lastModified
+	case errNotModified:
+	default:
+		writeJSONError(resp, http.StatusBadGateway, "unable to refresh database: "+hidden.Clean(result.err.Error()))
+		return
+	}
+	jsonData, err := json.Marshal(r)
+	if err != nil {
+		log.Errorf("Unable to encode refresh response: %v", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(jsonData)
+}
@@ -0,0 +1,87 @@
+package geoserve
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+)
+
+// reservedResponse is the response for ips that can't be geolocated because
+// they're invalid or not publicly routable
+type reservedResponse struct {
+	IP       string `json:"ip"`
+	Category string `json:"category"`
+}
+
+// reservedNets are the special-purpose networks that aren't publicly routable
+// beyond those classified by the net.IP methods, such as the shared address
+// space used for carrier-grade NAT and the documentation ranges
+var reservedNets = mustParseCIDRs(
+	"0.0.0.0/8",
+	"100.64.0.0/10",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"240.0.0.0/4",
+	"100::/64",
+	"2001:db8::/32",
+)
+
+// ipCategory classifies ip as "invalid", "private", "loopback", "link-local",
+// "multicast", "unspecified" or "reserved", or returns "" for public ips.
+func ipCategory(ip string) string {
+	parsed := net.ParseIP(ip)
+	switch {
+	case parsed == nil:
+		return "invalid"
+	case parsed.IsPrivate():
+		return "private"
+	case parsed.IsLoopback():
+		return "loopback"
+	case parsed.IsLinkLocalUnicast(), parsed.IsLinkLocalMulticast():
+		return "link-local"
+	case parsed.IsMulticast():
+		return "multicast"
+	case parsed.IsUnspecified():
+		return "unspecified"
+	case isReserved(parsed):
+		return "reserved"
+	default:
+		return ""
+	}
+}
+
+// isReserved determines whether ip is in one of the reservedNets
+func isReserved(ip net.IP) bool {
+	for _, network := range reservedNets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// mustParseCIDRs parses the given CIDRs, panicking if any is invalid
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
+
+// writeReserved responds to a lookup of a reserved or invalid ip with the
+// given status
+func writeReserved(resp http.ResponseWriter, ip string, category string, status int) {
+	jsonData, err := json.Marshal(&reservedResponse{ip, category})
+	if err != nil {
+		log.Errorf("Unable to encode response for reserved ip %v: %v", ip, err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	resp.Write(jsonData)
+}
@@ -0,0 +1,25 @@
+package geoserve
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrivateIPStatus(t *testing.T) {
+	for status, expected := range map[int]int{
+		http.StatusNotFound: http.StatusNotFound,
+		// Invalid statuses are ignored, so the ip is looked up as usual
+		42:   http.StatusOK,
+		1000: http.StatusOK,
+	} {
+		server := newTestServer(t, WithPrivateIPStatus(status))
+		resp := httptest.NewRecorder()
+		assert.NotPanics(t, func() {
+			server.Handle(resp, httptest.NewRequest(http.MethodGet, "/lookup/10.0.0.1", nil), "/lookup/", "")
+		})
+		assert.Equal(t, expected, resp.Code, "status %d", status)
+	}
+}
@@ -0,0 +1,92 @@
+package geoserve
+
+import (
+	"encoding/json"
+	"fmt"
+
+	geoip2 "github.com/oschwald/geoip2-golang"
+)
+
+// Cache is a cache of lookup results that can outlive the server and be shared
+// with other servers, for example one backed by Redis. It's consulted when a
+// result isn't in the server's own cache, before going to the database. See
+// WithSharedCache.
+//
+// Results are cached as JSON under keys that include the type and build epoch
+// of the database that produced them, so results from other versions of the
+// database are never used. Implementations may expire entries as they see fit
+// and must be safe for concurrent use.
+type Cache interface {
+	// Get returns the value cached under key, if any. Implementations should
+	// treat failures to reach their backing store as misses.
+	Get(key string) (value []byte, ok bool)
+
+	// Add caches value under key
+	Add(key string, value []byte)
+}
+
+// sharedCacheKey returns the key under which the result of lookup g, answered
+// by db, is shared, e.g. geoserve/GeoLite2-City/1704153600/brief/81.2.69.142.
+// The database type also tells apart editions.
+func (server *GeoServer) sharedCacheKey(db *database, g get) string {
+	meta := db.mmdb.Metadata
+	return fmt.Sprintf("geoserve/%s/%d/%s/%s", meta.DatabaseType, meta.BuildEpoch, server.cacheModeFor(g), g.ip)
+}
+
+// sharedResult gets the result of lookup g from the shared cache, or nil if
+// there's no shared cache or it doesn't have the result. It must be called with
+// the database read lock held.
+func (server *GeoServer) sharedResult(g get) *result {
+	if server.sharedCache == nil {
+		return nil
+	}
+	db, err := server.readerFor(g.edition)
+	if err != nil || db == nil {
+		return nil
+	}
+	jsonData, found := server.sharedCache.Get(server.sharedCacheKey(db, g))
+	if !found {
+		return nil
+	}
+	var record interface{}
+	if g.raw {
+		var raw map[string]interface{}
+		err = json.Unmarshal(jsonData, &raw)
+		record = raw
+	} else {
+		record = newRecordFor(db, g)
+		err = json.Unmarshal(jsonData, record)
+	}
+	if err != nil {
+		log.Errorf("Ignoring invalid shared result for %v: %v", g.ip, err)
+		return nil
+	}
+	return &result{record: record, jsonData: jsonData, source: "maxmind:" + editionOf(db), empty: isEmptyRecord(record)}
+}
+
+// shareResult adds res, the result of lookup g, to the shared cache if there
+// is one. It must be called with the database read lock held.
+func (server *GeoServer) shareResult(g get, res *result) {
+	if server.sharedCache == nil {
+		return
+	}
+	db, err := server.readerFor(g.edition)
+	if err != nil || db == nil {
+		return
+	}
+	server.sharedCache.Add(server.sharedCacheKey(db, g), res.jsonData)
+}
+
+// newRecordFor returns an empty record of the type into which lookupDB
+// decodes the result of lookup g in db, other than a raw one
+func newRecordFor(db *database, g get) interface{} {
+	switch {
+	case g.brief:
+		return &brief{}
+	case g.timezone:
+		return &timezoneRecord{}
+	case g.country:
+		return &geoip2.Country{}
+	}
+	return newFullRecord(db)
+}
@@ -0,0 +1,58 @@
+package geoserve
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// loadShedding configures shedding of lookups right after a database update,
+// when the freshly cleared cache sends a burst of misses to the database.
+type loadShedding struct {
+	window      time.Duration // how long after an update to shed load
+	maxInFlight int64         // in-flight lookups beyond which to shed
+	fraction    float64       // fraction of requests to shed
+}
+
+// shouldShed determines whether to shed the current request because we're
+// shortly after a database update and too many lookups are in flight.
+func (server *GeoServer) shouldShed() bool {
+	shed := server.shedding
+	if shed == nil || server.inFlight.Load() <= shed.maxInFlight {
+		return false
+	}
+	sinceSwap := server.clock.Now().Sub(time.Unix(0, server.lastSwap.Load()))
+	return sinceSwap < shed.window && rand.Float64() < shed.fraction
+}
+
+// startLookup counts a lookup as in flight, returning false without counting
+// it if the maximum number of lookups in flight (see WithMaxInFlight) has been
+// reached. Lookups that were started must be finished with finishLookup.
+func (server *GeoServer) startLookup() bool {
+	inFlight := server.inFlight.Add(1)
+	if server.maxInFlight > 0 && inFlight > server.maxInFlight {
+		server.inFlight.Add(-1)
+		server.metrics.overloadRejections.Add(1)
+		return false
+	}
+	return true
+}
+
+func (server *GeoServer) finishLookup() {
+	server.inFlight.Add(-1)
+}
+
+// writeOverloaded responds with 503 and a Retry-After of 1 second, telling the
+// client that the server is at capacity.
+func writeOverloaded(resp http.ResponseWriter) {
+	resp.Header().Set("Retry-After", "1")
+	writeJSONError(resp, http.StatusServiceUnavailable, "too many lookups in progress")
+}
+
+// writeShed responds with 429 and a Retry-After of 1 to 3 seconds, jittered so
+// that shed clients don't all come back at once.
+func writeShed(resp http.ResponseWriter) {
+	resp.Header().Set("Retry-After", strconv.Itoa(1+rand.Intn(3)))
+	resp.WriteHeader(http.StatusTooManyRequests)
+}
@@ -0,0 +1,50 @@
+package geoserve
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingCache is a shared cache whose Gets block until it's released
+type blockingCache struct {
+	release chan struct{}
+}
+
+func (c *blockingCache) Get(key string) ([]byte, bool) {
+	<-c.release
+	return nil, false
+}
+
+func (c *blockingCache) Add(key string, value []byte) {}
+
+func TestAbandonedLookupsStayInFlight(t *testing.T) {
+	shared := &blockingCache{release: make(chan struct{})}
+	server := newTestServer(t, WithSharedCache(shared), WithLookupTimeout(10*time.Millisecond), WithMaxInFlight(1))
+	lookup := func() *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		server.Handle(resp, httptest.NewRequest(http.MethodGet, "/lookup/"+testIP, nil), "/lookup/", "")
+		return resp
+	}
+
+	resp := lookup()
+	require.Equal(t, http.StatusServiceUnavailable, resp.Code)
+	assert.Contains(t, resp.Body.String(), "timed out")
+	assert.EqualValues(t, 1, server.inFlight.Load(), "the abandoned lookup is still running")
+	resp = lookup()
+	require.Equal(t, http.StatusServiceUnavailable, resp.Code)
+	assert.True(t, strings.Contains(resp.Body.String(), "too many lookups"), resp.Body.String())
+
+	close(shared.release)
+	deadline := time.Now().Add(5 * time.Second)
+	for server.inFlight.Load() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.EqualValues(t, 0, server.inFlight.Load())
+	assert.Equal(t, http.StatusOK, lookup().Code)
+}
@@ -0,0 +1,40 @@
+package geoserve
+
+import (
+	"encoding/json"
+
+	geoip2 "github.com/oschwald/geoip2-golang"
+
+	errors "github.com/getlantern/errors"
+)
+
+// timezoneRecord is the record of timezone lookups, served at
+// /lookup/timezone/<ip>
+type timezoneRecord struct {
+	IP       string `json:"ip"`
+	TimeZone string `json:"timezone"`
+}
+
+// timeZoneOf returns the IANA time zone of a *geoip2.City or
+// *geoip2.Enterprise record, or "" if it has none
+func timeZoneOf(record interface{}) string {
+	switch r := record.(type) {
+	case *geoip2.City:
+		return r.Location.TimeZone
+	case *geoip2.Enterprise:
+		return r.Location.TimeZone
+	case *timezoneRecord:
+		return r.TimeZone
+	}
+	return ""
+}
+
+// toTimezone converts the full result res for ip into a timezone one
+func toTimezone(ip string, res *result) (*result, error) {
+	tz := &timezoneRecord{IP: ip, TimeZone: timeZoneOf(res.record)}
+	jsonData, err := json.Marshal(tz)
+	if err != nil {
+		return nil, errors.New("Unable to encode timezone json response: %v", err)
+	}
+	return &result{record: tz, jsonData: jsonData, source: res.source, stale: res.stale, fresh: res.fresh, empty: res.empty}, nil
+}
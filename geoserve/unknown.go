@@ -0,0 +1,40 @@
+package geoserve
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+)
+
+// unknownResponse is the response for ips the database has no data for when
+// explicit unknowns are enabled
+type unknownResponse struct {
+	Found bool   `json:"found"`
+	IP    string `json:"ip"`
+}
+
+// isEmptyRecord determines whether record, as decoded from the database, holds
+// no data at all
+func isEmptyRecord(record interface{}) bool {
+	if r, isMap := record.(map[string]interface{}); isMap {
+		return len(r) == 0
+	}
+	// geoip2 records are pointers to structs, which are all zero values
+	v := reflect.ValueOf(record)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return false
+	}
+	return v.Elem().IsZero()
+}
+
+// writeUnknown answers with an unknownResponse for ip
+func writeUnknown(resp http.ResponseWriter, ip string) {
+	jsonData, err := json.Marshal(&unknownResponse{false, ip})
+	if err != nil {
+		log.Errorf("Unable to encode response for unknown ip %v: %v", ip, err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(jsonData)
+}
@@ -0,0 +1,54 @@
+package geoserve
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// version identifies the live database
+type version struct {
+	LastModified time.Time `json:"last_modified"`
+	DatabaseType string    `json:"database_type"`
+	BuildDate    time.Time `json:"build_date"`
+	// DBAge is the number of seconds since LastModified, if known
+	DBAge *int64 `json:"db_age,omitempty"`
+}
+
+// HandleVersion serves the Last-Modified time, type (e.g. GeoLite2-City), build
+// date and age in seconds of the live database as JSON, for example
+// {"last_modified":"2024-01-02T00:00:00Z","database_type":"GeoLite2-City","build_date":"2024-01-01T12:00:00Z","db_age":3600}.
+// The age is left out while serving a fallback database, whose Last-Modified
+// time isn't known. It answers 503 if no database is loaded yet.
+func (server *GeoServer) HandleVersion(resp http.ResponseWriter, req *http.Request) {
+	server.dbMx.RLock()
+	db := server.db
+	var buildEpoch uint
+	if db != nil {
+		buildEpoch = db.mmdb.Metadata.BuildEpoch
+	}
+	server.dbMx.RUnlock()
+	if db == nil {
+		writeJSONError(resp, http.StatusServiceUnavailable, "no database loaded yet")
+		return
+	}
+	_, dbType := server.getDbData()
+	lastModified := server.getDbLastModified()
+	v := &version{
+		LastModified: lastModified.UTC(),
+		DatabaseType: dbType,
+		BuildDate:    time.Unix(int64(buildEpoch), 0).UTC(),
+	}
+	if !lastModified.IsZero() {
+		age := int64(server.clock.Now().Sub(lastModified) / time.Second)
+		v.DBAge = &age
+	}
+	jsonData, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf("Unable to encode version: %v", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(jsonData)
+}
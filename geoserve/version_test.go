@@ -0,0 +1,26 @@
+package geoserve
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleVersionReportsAge(t *testing.T) {
+	clock := newFakeClock()
+	server := newTestServer(t, withClock(clock))
+	clock.advance(time.Hour)
+
+	resp := httptest.NewRecorder()
+	server.HandleVersion(resp, httptest.NewRequest(http.MethodGet, "/version", nil))
+	require.Equal(t, http.StatusOK, resp.Code)
+	var v map[string]interface{}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &v))
+	assert.Equal(t, "GeoLite2-City", v["database_type"])
+	assert.EqualValues(t, 3600, v["db_age"])
+}
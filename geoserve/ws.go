@@ -0,0 +1,102 @@
+package geoserve
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	errors "github.com/getlantern/errors"
+)
+
+const (
+	// wsIdleTimeout is how long a WebSocket connection may go without the
+	// client sending an ip before it's closed
+	wsIdleTimeout = 5 * time.Minute
+
+	// wsMaxMessageBytes bounds the size of messages from clients, which are
+	// just ips
+	wsMaxMessageBytes = 1024
+)
+
+// HandleWebSocket streams lookups over a WebSocket connection. The client
+// sends one ip per text message and receives a JSON message for each,
+// {"ip":...,"result":...} with the same result as Handle, or
+// {"ip":...,"error":...} if the ip is invalid or its lookup failed. Results
+// are sent in the order the ips were received. Connections are closed after
+// going idle for 5 minutes and when the server is closed.
+//
+// Browsers may only connect from the origins in allowOrigin (see
+// setAllowOrigin) or from the server's own origin.
+func (server *GeoServer) HandleWebSocket(resp http.ResponseWriter, req *http.Request, allowOrigin string) {
+	if !server.clientAllowed(req) {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+	ws := websocket.Server{
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			return checkWebSocketOrigin(req, allowOrigin)
+		},
+		Handler: server.streamLookups,
+	}
+	ws.ServeHTTP(resp, req)
+}
+
+// checkWebSocketOrigin makes sure that browsers only connect from allowed
+// origins. Other clients don't send an Origin header.
+func checkWebSocketOrigin(req *http.Request, allowOrigin string) error {
+	origin := req.Header.Get("Origin")
+	if origin == "" || strings.TrimPrefix(strings.TrimPrefix(origin, "http://"), "https://") == req.Host {
+		return nil
+	}
+	for _, allowed := range strings.Split(allowOrigin, ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return nil
+		}
+	}
+	return errors.New("origin %v not allowed", origin)
+}
+
+// streamLookups answers the ips received on conn until the client goes away,
+// goes idle or the server is closed
+func (server *GeoServer) streamLookups(conn *websocket.Conn) {
+	conn.MaxPayloadBytes = wsMaxMessageBytes
+	// Unblock the read below when the server is closed
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-server.done:
+			conn.Close()
+		case <-finished:
+		}
+	}()
+	defer conn.Close()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(wsIdleTimeout))
+		var msg string
+		err := websocket.Message.Receive(conn, &msg)
+		if err != nil {
+			log.Tracef("Closing WebSocket connection: %v", err)
+			return
+		}
+		ip := strings.TrimSpace(msg)
+		entry := &listEntry{IP: ip}
+		if net.ParseIP(ip) == nil {
+			entry.Error = "invalid ip address"
+		} else if gr := server.query(get{ip: ip}); gr.res != nil {
+			entry.Result = gr.res.jsonData
+		} else {
+			entry.Error = "lookup failed"
+		}
+		err = websocket.JSON.Send(conn, entry)
+		if err != nil {
+			log.Tracef("Unable to send lookup over WebSocket: %v", err)
+			return
+		}
+	}
+}
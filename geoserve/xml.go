@@ -0,0 +1,78 @@
+package geoserve
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"sort"
+
+	errors "github.com/getlantern/errors"
+)
+
+// xmlRootElement is the name of the root element of XML responses
+const xmlRootElement = "geolocation"
+
+// xmlArrayElement is the name of the elements holding the items of arrays
+const xmlArrayElement = "item"
+
+// jsonToXML converts the json response jsonData to XML. Objects become
+// elements named after their keys, in sorted order, and arrays become
+// repeated item elements, so that every response format (raw records,
+// includes, etc.) has an XML equivalent.
+func jsonToXML(jsonData []byte) ([]byte, error) {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(jsonData))
+	decoder.UseNumber()
+	err := decoder.Decode(&value)
+	if err != nil {
+		return nil, errors.New("unable to decode json for xml: %v", err)
+	}
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	encoder := xml.NewEncoder(&buf)
+	err = encodeXML(encoder, xmlRootElement, value)
+	if err == nil {
+		err = encoder.Flush()
+	}
+	if err != nil {
+		return nil, errors.New("unable to encode xml: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeXML encodes value, decoded from json, as the element name
+func encodeXML(encoder *xml.Encoder, name string, value interface{}) error {
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	if value == nil {
+		return encoder.EncodeElement("", start)
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if err := encoder.EncodeToken(start); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := encodeXML(encoder, key, v[key]); err != nil {
+				return err
+			}
+		}
+		return encoder.EncodeToken(start.End())
+	case []interface{}:
+		if err := encoder.EncodeToken(start); err != nil {
+			return err
+		}
+		for _, item := range v {
+			if err := encodeXML(encoder, xmlArrayElement, item); err != nil {
+				return err
+			}
+		}
+		return encoder.EncodeToken(start.End())
+	default:
+		return encoder.EncodeElement(v, start)
+	}
+}
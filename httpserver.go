@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// newHTTPServer constructs the http.Server listening at addr, with HTTP/2
+// enabled (over TLS via ALPN and in cleartext via h2c) and its connection
+// handling tuned from the environment.
+func newHTTPServer(addr string, handler http.Handler) *http.Server {
+	h2s := &http2.Server{
+		MaxConcurrentStreams: uint32(intFromEnv("HTTP2_MAX_CONCURRENT_STREAMS", 0)),
+		IdleTimeout:          durationFromEnv("IDLE_TIMEOUT", 0),
+	}
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           h2c.NewHandler(handler, h2s),
+		ReadTimeout:       durationFromEnv("READ_TIMEOUT", 0),
+		ReadHeaderTimeout: durationFromEnv("READ_HEADER_TIMEOUT", 0),
+		WriteTimeout:      durationFromEnv("WRITE_TIMEOUT", 0),
+		IdleTimeout:       durationFromEnv("IDLE_TIMEOUT", 0),
+	}
+	if os.Getenv("KEEP_ALIVES") == "false" {
+		server.SetKeepAlivesEnabled(false)
+	}
+	err := http2.ConfigureServer(server, h2s)
+	if err != nil {
+		log.Fatalf("Unable to configure HTTP/2: %s", err)
+	}
+	return server
+}
+
+// checkTLSFiles checks that certFile and keyFile are both given and hold a
+// valid certificate and matching key, so that problems are reported at
+// startup rather than on the first connection
+func checkTLSFiles(certFile, keyFile string) error {
+	if certFile == "" || keyFile == "" {
+		return fmt.Errorf("TLS_CERT and TLS_KEY must be set together")
+	}
+	_, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load TLS certificate %v and key %v: %v", certFile, keyFile, err)
+	}
+	return nil
+}
+
+// redirectToHTTPS permanently redirects requests to the same host and path
+// over HTTPS on httpsPort
+func redirectToHTTPS(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.Host)
+		if err != nil {
+			// No port
+			host = req.Host
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		// 308 rather than 301 so that POSTs are repeated as POSTs
+		http.Redirect(resp, req, "https://"+host+req.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
@@ -5,12 +5,86 @@
 //
 // The server caches JSON results by ip address for low-latency lookups.
 //
+// To geolocate ips from the command line without running a server, which
+// prints one {"ip":...,"result":...} JSON object per ip using DB or DB_URL:
+//
+//	go-geoserve lookup 66.69.242.177 81.2.69.160
+//
 // When starting the server, the following environment variables control its
 // behavior:
 //
 //	PORT - integer port on which to listen
-//	DB - optional filename of local database file (useful for testing, not Heroku)
-//	ALLOW_ORIGIN - optional cors access control for the response header ("*", "example.com", etc.)
+//	TLS_CERT, TLS_KEY - optional filenames of a PEM certificate (chain) and its private key, if both are set serve HTTPS rather than HTTP on PORT
+//	HTTP_REDIRECT_PORT - optional integer port on which to redirect HTTP requests to HTTPS on PORT, when serving HTTPS
+//	BIND_ADDR - optional host or ip address of the interface on which to listen for HTTP and gRPC, e.g. 127.0.0.1 (default all interfaces)
+//	GRPC_PORT - optional integer port on which to serve the gRPC service defined in geoserve/geoservepb
+//	DB - optional filename of local database file (useful for testing, not Heroku), or "-" to read the database from stdin, in which case it is never updated
+//	DB_LOAD_ATTEMPTS - number of attempts to read the DB file at startup (default 1)
+//	DB_LOAD_RETRY_INTERVAL - time between attempts to read the DB file (default 5s)
+//	DB_URL - URL of the database to download and keep current if DB isn't set, either http(s)://, file:///path, s3://bucket/key or gs://bucket/object
+//	AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN - optional credentials for s3:// URLs, which are fetched anonymously without them
+//	AWS_REGION - region of the buckets of s3:// URLs (default AWS_DEFAULT_REGION or us-east-1)
+//	AWS_ENDPOINT_URL - optional endpoint of an S3-compatible service to use for s3:// URLs instead of Amazon S3
+//	GOOGLE_OAUTH_ACCESS_TOKEN - optional access token for gs:// URLs, otherwise one for the default service account is used when running on Google Cloud
+//	DB_FALLBACK - optional filename of a database to serve until the one from DB_URL has been downloaded
+//	DB_WAIT_TIMEOUT - optional time to wait at startup for the database to be downloaded from DB_URL before serving, exiting if it isn't (default 0, serve right away and answer lookups with 500 until it is)
+//	DB_REFRESH_INTERVAL - time between checks of DB_URL for a new database (default 1h)
+//	DB_RETRY_INTERVAL - time before checking DB_URL again after a failed check (default 5m)
+//	DB_TYPE - optional MaxMind database type downloaded from DB_URL, e.g. GeoIP2-Enterprise, GeoIP2-ISP or GeoIP2-Connection-Type, whose fields are all included in lookups (default GeoLite2-City or GeoLite2-Country)
+//	ANONYMOUS_DB - optional filename of a GeoIP2-Anonymous-IP database enabling /anonymous/
+//	ANONYMOUS_DB_URL - optional URL from which to download the GeoIP2-Anonymous-IP database instead, checked as often as DB_URL
+//	DB_URLS - optional comma-separated <type>=<url> pairs of additional databases to download and keep current, e.g. GeoIP2-Anonymous-IP=https://example.com/anonymous.tar.gz
+//	DB_CACHE_DIR - optional directory in which to save the database downloaded from DB_URL, so that restarts don't download it again unless it changed
+//	ALLOW_ORIGIN - optional comma-separated list of origins allowed by cors, e.g. "https://example.com,https://app.example.com", whichever matches the request's Origin is echoed back, or "*" to allow any
+//	MAX_PATH_LENGTH - optional limit on the path length beyond /lookup/, longer paths get 414 (default 64, 0 disables)
+//	NEAREST_CITY - optional, if "true" index the cities of the database when it's loaded to find the city nearest to given coordinates at /nearest
+//	LOOKUP_TIMEOUT - optional limit on how long to wait for a lookup before answering 503, e.g. 2s (default 0, no limit)
+//	MAX_CIDR_ADDRESSES - optional limit on the number of addresses in ranges looked up at /lookup/cidr/, larger ranges get 400 (default 65536)
+//	EDITION_DBS - optional comma-separated filenames of additional database editions, selectable with the X-Geo-Edition header
+//	LOG_REQUESTS - optional, if "true" log client ip, looked up ip, country, cache hit or miss, status and latency for each lookup
+//	STALE_ON_ERROR - optional, if "true" serve the last good result (flagged "stale":true) when a lookup fails
+//	DEBUG_UI - optional, if "true" serve an HTML page for manual lookups at /
+//	IP_LISTS - optional filename of a JSON object mapping list names to arrays of ips, served as NDJSON at /list/<name>
+//	PRIVATE_IP_STATUS - optional HTTP status (200-599, e.g. 200 or 404) for private, reserved and invalid ips, answered with {"ip":...,"category":...} instead of a lookup
+//	ALLOW_CLIENT_CIDRS - optional comma-separated CIDR ranges (e.g. 10.0.0.0/8,192.168.0.0/16) that clients must be in, others are answered with 403
+//	TRUSTED_PROXIES - optional comma-separated CIDR ranges of proxies whose X-Forwarded-For header identifies the client, e.g. 10.0.0.0/8, otherwise clients are identified by their remote address. Behind a router whose ips aren't known, such as Heroku's, 0.0.0.0/0,::/0 trusts the leftmost X-Forwarded-For address, which clients can fake
+//	ADMIN_TOKEN - optional shared secret enabling the admin endpoints, supplied in the X-Admin-Token header
+//	ADMIN_LOG_LINES - number of recent log lines kept for /admin/logs (default 1000)
+//	HEALTH_MAX_UPDATE_AGE - time since the database was last updated or confirmed current after which /health answers 503 (default 24h, 0 disables)
+//	CACHE_POLICY - optional cache eviction policy, "lru" (default) or "lfu"
+//	CACHE_TTL - optional maximum age of cached results, e.g. 6h (default 0, no limit)
+//	NEGATIVE_CACHE_TTL - optional maximum age of cached results for ips the database has no data for, e.g. 5m (default CACHE_TTL)
+//	CACHE_MAX_AGE - optional max-age of the Cache-Control header of lookup responses, e.g. 1h (default 0, no header)
+//	CACHE_SIZE - optional capacity of each cache, 0 disables caching (default 50000)
+//	CACHE_SIZE_CITY, CACHE_SIZE_COUNTRY, CACHE_SIZE_RAW, CACHE_SIZE_BRIEF, CACHE_SIZE_TIMEZONE - optional capacities of the caches for full, /lookup/country/, /lookup/raw/, ?mode=brief and /lookup/timezone/ lookups (default CACHE_SIZE)
+//	CACHE_AUTOTUNE_INTERVAL - optional, if set resize the caches this often to reach a target hit rate within a memory ceiling, configured with:
+//	CACHE_AUTOTUNE_MIN_SIZE, CACHE_AUTOTUNE_MAX_SIZE - bounds on the size of each cache (default 1000 and 1000000)
+//	CACHE_AUTOTUNE_TARGET_HIT_RATE - hit rate below which caches grow (default 0.9)
+//	CACHE_AUTOTUNE_MAX_MEMORY_MB - heap size above which caches shrink (default 512)
+//	CACHE_CHURN_INTERVAL - how often to log the fraction of cache entries added and evicted, also served at /admin/cache (default 5m, 0 to disable)
+//	MAX_IN_FLIGHT - optional maximum number of lookups in progress at once, beyond which requests are answered right away with 503 (default 0, no limit)
+//	SHED_MAX_IN_FLIGHT - optional, if set shed load with 429s when more lookups than this are in flight shortly after a database update
+//	SHED_WINDOW - how long after a database update to shed load (default 1m)
+//	SHED_FRACTION - fraction of requests to shed (default 0.5)
+//	RATE_LIMIT - optional, if set limit each client ip to this many lookups per second, answering excess requests with 429
+//	RATE_LIMIT_BURST - number of lookups a client ip may make at once before RATE_LIMIT applies (default RATE_LIMIT rounded up)
+//	EXPLICIT_UNKNOWN - if "true", ips without data in the database are answered with {"found":false,"ip":...} instead of a record of zero values
+//	REFLECT_IP - if "false", lookup responses don't carry an X-Reflected-Ip header with the ip that was looked up (default true)
+//	DEFAULT_CASE - optional casing of the keys of all responses, "camel", "snake" or "pascal", unless requested with ?case=
+//	CONFIDENCE_WEIGHT_ACCURACY, CONFIDENCE_WEIGHT_CITY, CONFIDENCE_WEIGHT_COUNTRY - optional relative weights of the factors of ?include=confidence (default 50, 30 and 20)
+//	DEFAULT_LANG - optional language (e.g. "en") that Names maps in all responses are collapsed to, unless requested otherwise with ?lang= (or ?lang=all) or Accept-Language
+//	OVERRIDE_URL - optional base URL of an override service, queried as <OVERRIDE_URL>/<ip> before the database and skipped for 30s after it fails
+//	SERVER_IP - optional public ip of the server, geolocated at /myip
+//	SERVER_IP_URL - optional URL of an ip echo service answering with the server's public ip as plain text, e.g. https://api.ipify.org, used for /myip if SERVER_IP isn't set
+//	SERVER_IP_TTL - how long to cache the ip from SERVER_IP_URL (default 1h)
+//
+// The HTTP server speaks HTTP/1.1 and HTTP/2 (including cleartext h2c). Its
+// connection handling can be tuned with these optional environment variables:
+//
+//	READ_TIMEOUT, READ_HEADER_TIMEOUT, WRITE_TIMEOUT - durations like "10s" (default none)
+//	IDLE_TIMEOUT - how long idle keep-alive connections are kept open (default none)
+//	KEEP_ALIVES - set to "false" to disable keep-alive connections
+//	HTTP2_MAX_CONCURRENT_STREAMS - limit on concurrent HTTP/2 streams per connection
 //
 // To request JSON geolocation information for your IP:
 //
@@ -20,7 +94,27 @@
 //
 //	curl http://go-geoserve.herokuapp.com/lookup/66.69.242.177
 //
-// Sample response:
+// IPv4 addresses may also be given as integers, in decimal or 0x-prefixed hex:
+//
+//	curl http://go-geoserve.herokuapp.com/lookup/int/1111880369
+//
+// To get the raw database record, which also works with custom mmdb files of
+// any schema:
+//
+//	curl http://go-geoserve.herokuapp.com/lookup/raw/66.69.242.177
+//
+// To get just the much smaller country-level record (continent, country,
+// registered and represented country and traits):
+//
+//	curl http://go-geoserve.herokuapp.com/lookup/country/66.69.242.177
+//
+// To get just the IANA time zone, e.g.
+// {"ip":"66.69.242.177","timezone":"America/Chicago"}, or 404 if the database
+// has none for the ip:
+//
+//	curl http://go-geoserve.herokuapp.com/lookup/timezone/66.69.242.177
+//
+// Sample response for a full lookup:
 //
 //	{
 //	    "City": {
@@ -110,39 +204,526 @@
 //	        "IsSatelliteProvider": false
 //	    }
 //	}
+//
+// Responses from the database for a given ip carry a Last-Modified header with
+// the time the database was last modified, and requests with an
+// If-Modified-Since header at least as recent are answered with 304 Not
+// Modified. Lookups of the client's own ip don't, since the client's ip may
+// have changed since. All responses from the database also carry an ETag
+// derived from the response body, and requests with a matching If-None-Match
+// header are likewise answered with 304. With CACHE_MAX_AGE set, they carry a
+// Cache-Control header too, public for lookups of a given ip and private for
+// lookups of the client's own ip:
+//
+//	curl -i -H 'If-None-Match: W/"8f3b1c2d4e5f6a7b"' http://go-geoserve.herokuapp.com/lookup/66.69.242.177
+//
+// To get just the country and region ISO codes and the English city name, e.g.
+// {"country":"US","region":"TX","city":"Austin"}:
+//
+//	curl http://go-geoserve.herokuapp.com/lookup/66.69.242.177?mode=brief
+//
+// To get the same as a URL query string, e.g. for composing redirects, with
+// empty fields omitted:
+//
+//	curl http://go-geoserve.herokuapp.com/lookup/66.69.242.177?format=querystring
+//
+// To get a CSV header and row with the columns ip, country_iso, country_name,
+// region, city, latitude, longitude and time_zone, e.g. for spreadsheets, add
+// format=csv or send Accept: text/csv:
+//
+//	curl http://go-geoserve.herokuapp.com/lookup/66.69.242.177?format=csv
+//
+// To get a flat JSON object with English names, e.g. {"ip":"66.69.242.177",
+// "country":"US","country_name":"United States","region":"TX",
+// "region_name":"Texas","city":"Austin","lat":30.2672,"lon":-97.7431,
+// "timezone":"America/Chicago"}, with "" or null for unknown fields:
+//
+//	curl http://go-geoserve.herokuapp.com/lookup/66.69.242.177?format=flat
+//
+// To get the response as XML, with a <geolocation> element holding an element
+// per field and <item> elements for the entries of lists, add format=xml or
+// send Accept: application/xml:
+//
+//	curl http://go-geoserve.herokuapp.com/lookup/66.69.242.177?format=xml
+//
+// To get the response as MessagePack, which is smaller and cheaper to decode
+// than JSON, add format=msgpack or send Accept: application/msgpack:
+//
+//	curl -H 'Accept: application/msgpack' http://go-geoserve.herokuapp.com/lookup/66.69.242.177
+//
+// To get only some fields, e.g. {"Location":{"Latitude":30.2672,"Longitude":-97.7431}},
+// list their dotted paths in any casing:
+//
+//	curl "http://go-geoserve.herokuapp.com/lookup/66.69.242.177?fields=location.latitude,location.longitude"
+//
+// For browser clients that can't use CORS, add a callback parameter to get the
+// JSON wrapped in a call to the named function (JSONP):
+//
+//	curl http://go-geoserve.herokuapp.com/lookup/66.69.242.177?callback=showLocation
+//
+// To get the keys in camelCase (e.g. "isoCode"), snake_case ("iso_code") or
+// PascalCase ("IsoCode"), add a case parameter of camel, snake or pascal:
+//
+//	curl http://go-geoserve.herokuapp.com/lookup/66.69.242.177?case=snake
+//
+// The sample above contains the names in every language the database has. To
+// collapse every Names map to a single language, e.g. "Names": {"en": "Austin"},
+// pass a lang parameter or an Accept-Language header. Entities without a name
+// in the requested language fall back to English.
+//
+//	curl http://go-geoserve.herokuapp.com/lookup/66.69.242.177?lang=de
+//
+// When DEFAULT_LANG is set, names are collapsed to that language unless
+// requested otherwise, and clients that need all languages must ask for them:
+//
+//	curl http://go-geoserve.herokuapp.com/lookup/66.69.242.177?lang=all
+//
+// To include optional fields derived from the geolocation, add an include
+// parameter with a comma-separated list of fields:
+//
+//	curl http://go-geoserve.herokuapp.com/lookup/66.69.242.177?include=currency
+//
+// The following optional fields are supported:
+//
+//	currency - ISO 4217 code of the country's primary currency, plus a
+//	           "currencies" list for countries with more than one
+//	region   - ISO code of the first subdivision (e.g. state), plus its
+//	           English "region_name", omitted when there are no subdivisions
+//	geohash  - geohash of the coordinates, with a precision parameter of 1-12
+//	           characters (default 7), omitted when coordinates are unknown
+//	airport  - IATA code of and distance to the nearest major airport, e.g.
+//	           {"iata":"AUS","distance_km":12.3}, omitted when coordinates are
+//	           unknown
+//	country_flags - geolocated and registered countries and whether they
+//	           differ, e.g. {"geo_country":"DE","registered_country":"NL",
+//	           "diverges":true}
+//	confidence - score of 0-100 for how trustworthy the geolocation is, the
+//	           weighted average of the accuracy radius (1 - radius/1000km),
+//	           whether the city is known and whether the geolocated and
+//	           registered countries agree, see CONFIDENCE_WEIGHT_*
+//	db_age   - age in seconds of the live database based on its last-modified
+//	           time, e.g. 187390, making the response uncacheable
+//	found    - whether the database has any data for the ip, along with the
+//	           "ip" that was looked up, to tell unknown ips from a broken server
+//	provenance - object mapping each top-level field to its source: "override",
+//	           "maxmind:<edition>", "static" (built-in tables), "computed" or
+//	           "server"
+//
+// To geolocate up to 1000 ips at once, POST them as a JSON array to the batch
+// endpoint, which answers with an object mapping each ip to its geolocation,
+// to {"error":"invalid ip address"} if it isn't an ip or to null if it
+// couldn't be looked up. The aggregate parameter works here too, see below.
+//
+//	curl -d '["66.69.242.177","81.2.69.160"]' http://go-geoserve.herokuapp.com/lookup/batch
+//
+// To geolocate a range of ips, which answers with the geolocation of its first
+// address and the countries of 16 addresses sampled across it, e.g.
+// {"cidr":"81.2.69.0/24","addresses":256,"representative":"81.2.69.0",
+// "geolocation":{...},"sampled":16,"countries":{"GB":16},"same_country":true}:
+//
+//	curl "http://go-geoserve.herokuapp.com/lookup/cidr/?cidr=81.2.69.0/24"
+//
+// To stream the geolocations of a preconfigured list of ips (see IP_LISTS) as
+// newline-delimited JSON:
+//
+//	curl http://go-geoserve.herokuapp.com/list/egress
+//
+// or just the number of them in each country, region or continent, e.g.
+// {"aggregate":"country","counts":{"DE":1,"US":2,"unknown":1}}:
+//
+//	curl http://go-geoserve.herokuapp.com/list/egress?aggregate=country
+//
+// To check whether an ip is geolocated to a given country, which answers e.g.
+// {"in_country":true,"actual":"US"}:
+//
+//	curl "http://go-geoserve.herokuapp.com/in-country?ip=66.69.242.177&country=US"
+//
+// To check whether an ip is an anonymous VPN, hosting provider, public proxy
+// or Tor exit node, with ANONYMOUS_DB or ANONYMOUS_DB_URL set, e.g.
+// {"ip":"66.69.242.177","is_anonymous":false,"is_anonymous_vpn":false,
+// "is_hosting_provider":false,"is_public_proxy":false,"is_tor_exit_node":false}:
+//
+//	curl http://go-geoserve.herokuapp.com/anonymous/66.69.242.177
+//
+// To get the great-circle distance between the locations of two ips, e.g.
+// {"from":{"ip":"66.69.242.177","latitude":30.2672,"longitude":-97.7431},
+// "to":{"ip":"81.2.69.160","latitude":52.5244,"longitude":13.4105},"distance_km":8657.2}:
+//
+//	curl "http://go-geoserve.herokuapp.com/distance?from=66.69.242.177&to=81.2.69.160"
+//
+// To get only the fields that changed since a previously fetched record, POST
+// that record to the diff endpoint:
+//
+//	curl -d @previous.json http://go-geoserve.herokuapp.com/lookup/66.69.242.177/diff
+//
+// To find the city nearest to given coordinates, with NEAREST_CITY set, e.g.
+// {"geoname_id":4671654,"city":"Austin","region":"TX","country":"US",
+// "latitude":30.2672,"longitude":-97.7431,"distance_km":0.7}:
+//
+//	curl "http://go-geoserve.herokuapp.com/nearest?lat=30.26&lon=-97.74"
+//
+// To stream lookups over a WebSocket connection, send one ip per message to /ws
+// and receive a {"ip":...,"result":...} message for each, e.g. with websocat:
+//
+//	echo 66.69.242.177 | websocat ws://go-geoserve.herokuapp.com/ws
+//
+// To geolocate the server's own public ip, with SERVER_IP or SERVER_IP_URL
+// set, e.g. {"ip":"66.69.242.177","geolocation":{...}}:
+//
+//	curl http://go-geoserve.herokuapp.com/myip
+//
+// To check whether a database has been loaded and whether updating it is
+// failing, e.g. {"db_loaded":true,"last_modified":"2024-01-01T00:00:00Z",
+// "last_successful_update":"2024-01-02T15:04:05Z","consecutive_update_failures":0},
+// which answers 503 if no database is loaded yet or it hasn't been updated
+// within HEALTH_MAX_UPDATE_AGE, for use by load balancers and readiness probes:
+//
+//	curl http://go-geoserve.herokuapp.com/health
+//
+// To check which database is live and how old it is in seconds, e.g.
+// {"last_modified":"2024-01-02T00:00:00Z","database_type":"GeoLite2-City",
+// "build_date":"2024-01-01T12:00:00Z","db_age":3600}:
+//
+//	curl http://go-geoserve.herokuapp.com/version
+//
+// Lookup and database update statistics are available for Prometheus at:
+//
+//	curl http://go-geoserve.herokuapp.com/metrics
+//
+// When ADMIN_TOKEN is set, the most recent log lines are available with:
+//
+//	curl -H "X-Admin-Token: $ADMIN_TOKEN" http://go-geoserve.herokuapp.com/admin/logs?n=100
+//
+// and the cache churn over the last CACHE_CHURN_INTERVAL with:
+//
+//	curl -H "X-Admin-Token: $ADMIN_TOKEN" http://go-geoserve.herokuapp.com/admin/cache
+//
+// and the live database file itself, for lookups on the client, with:
+//
+//	curl -H "X-Admin-Token: $ADMIN_TOKEN" -o GeoLite2-City.mmdb http://go-geoserve.herokuapp.com/database
+//
+// To check DB_URL for a new database right away, rather than waiting for the
+// next DB_REFRESH_INTERVAL, which answers e.g.
+// {"applied":true,"last_modified":"2024-01-02T00:00:00Z"} or {"applied":false}:
+//
+//	curl -X POST -H "X-Admin-Token: $ADMIN_TOKEN" http://go-geoserve.herokuapp.com/admin/refresh
 package main
 
 import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/getlantern/golog"
+	"google.golang.org/grpc"
 
 	"github.com/getlantern/go-geoserve/geoserve"
 )
 
 var (
 	log = golog.LoggerFor("go-geoserve")
+
+	//go:embed debug.html
+	debugHTML     string
+	debugTemplate = template.Must(template.New("debug").Parse(debugHTML))
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "lookup" {
+		os.Exit(runLookup(os.Args[2:]))
+	}
+
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	var logs *geoserve.LogBuffer
+	if adminToken != "" {
+		logLines := intFromEnv("ADMIN_LOG_LINES", geoserve.DefaultLogBufferSize)
+		if logLines < 1 {
+			log.Fatalf("ADMIN_LOG_LINES must be at least 1, got %d", logLines)
+		}
+		logs = geoserve.NewLogBuffer(logLines)
+		golog.SetOutputs(io.MultiWriter(os.Stderr, logs), io.MultiWriter(os.Stdout, logs))
+	}
+
+	// Bind first so that a bad or unavailable port is reported right away
+	// rather than after the database has loaded
+	port := os.Getenv("PORT")
+	bindAddr := os.Getenv("BIND_ADDR")
+	listener, err := listen("PORT", bindAddr, port)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	tlsCert, tlsKey := os.Getenv("TLS_CERT"), os.Getenv("TLS_KEY")
+	var redirectListener net.Listener
+	if tlsCert != "" || tlsKey != "" {
+		err = checkTLSFiles(tlsCert, tlsKey)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		if redirectPort := os.Getenv("HTTP_REDIRECT_PORT"); redirectPort != "" {
+			redirectListener, err = listen("HTTP_REDIRECT_PORT", bindAddr, redirectPort)
+			if err != nil {
+				log.Fatalf("%v", err)
+			}
+		}
+	}
+
 	log.Debug("Creating GeoServer, this can take a while")
-	geoServer, err := geoserve.NewServer(os.Getenv("DB"), os.Getenv("DB_URL"))
+	geoServer, err := geoserve.NewServer(os.Getenv("DB"), os.Getenv("DB_URL"), serverOptions()...)
 	if err != nil {
 		log.Fatalf("Unable to create geoserve server: %s", err)
 	}
 	allowOrigin := os.Getenv("ALLOW_ORIGIN")
 	log.Debugf("Access-Control-Allow-Origin set to: %s", allowOrigin)
-	http.HandleFunc("/lookup/", func(resp http.ResponseWriter, req *http.Request) {
-		geoServer.Handle(resp, req, "/lookup/", allowOrigin)
-	})
-	http.HandleFunc("/lookup", func(resp http.ResponseWriter, req *http.Request) {
-		geoServer.Handle(resp, req, "/lookup", allowOrigin)
-	})
-	port := os.Getenv("PORT")
-	log.Debugf("About to listen at port: %s", port)
-	err = http.ListenAndServe(":"+port, nil)
+	limit := func(handler http.Handler) http.Handler { return handler }
+	if rateLimit := floatFromEnv("RATE_LIMIT", 0); rateLimit > 0 {
+		log.Debugf("Limiting lookups to %v per second per client", rateLimit)
+		limit = geoserve.NewRateLimiter(rateLimit, intFromEnv("RATE_LIMIT_BURST", 0), geoServer.ClientIP).Limit
+	}
+	lookups := http.NewServeMux()
+	geoServer.Register(lookups, "/lookup", allowOrigin)
+	http.Handle("/lookup", limit(lookups))
+	http.Handle("/lookup/", limit(lookups))
+	http.Handle("/list/", limit(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		geoServer.HandleList(resp, req, "/list/")
+	})))
+	http.Handle("/in-country", limit(http.HandlerFunc(geoServer.HandleInCountry)))
+	http.Handle("/anonymous/", limit(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		geoServer.HandleAnonymous(resp, req, "/anonymous/")
+	})))
+	http.Handle("/nearest", limit(http.HandlerFunc(geoServer.HandleNearest)))
+	http.Handle("/nearest/", limit(http.HandlerFunc(geoServer.HandleNearest)))
+	http.Handle("/ws", limit(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		geoServer.HandleWebSocket(resp, req, allowOrigin)
+	})))
+	http.Handle("/myip", limit(http.HandlerFunc(geoServer.HandleMyIP)))
+	http.Handle("/distance", limit(http.HandlerFunc(geoServer.HandleDistance)))
+	http.Handle("/distance/", limit(http.HandlerFunc(geoServer.HandleDistance)))
+	http.HandleFunc("/health", geoServer.HandleHealth)
+	http.HandleFunc("/version", geoServer.HandleVersion)
+	http.HandleFunc("/metrics", geoServer.HandleMetrics)
+	if adminToken != "" {
+		log.Debug("Serving admin endpoints at /admin/ and /database")
+		http.Handle("/admin/logs", geoserve.RequireAdmin(adminToken, logs))
+		http.Handle("/admin/cache", geoserve.RequireAdmin(adminToken, http.HandlerFunc(geoServer.HandleCacheChurn)))
+		http.Handle("/admin/refresh", geoserve.RequireAdmin(adminToken, http.HandlerFunc(geoServer.HandleRefresh)))
+		http.Handle("/database", geoserve.RequireAdmin(adminToken, http.HandlerFunc(geoServer.HandleDatabase)))
+	}
+	if grpcPort := os.Getenv("GRPC_PORT"); grpcPort != "" {
+		grpcListener, err := listen("GRPC_PORT", bindAddr, grpcPort)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		grpcServer := grpc.NewServer()
+		geoServer.RegisterGRPC(grpcServer)
+		log.Debugf("About to serve gRPC at port: %s", grpcPort)
+		go func() {
+			err := grpcServer.Serve(grpcListener)
+			if err != nil {
+				log.Fatalf("Unable to start gRPC server: %s", err)
+			}
+		}()
+	}
+	if os.Getenv("DEBUG_UI") == "true" {
+		log.Debug("Serving debug UI at /")
+		http.HandleFunc("/", handleDebugUI)
+	}
+	if redirectListener != nil {
+		log.Debugf("About to redirect HTTP to HTTPS at: %v", redirectListener.Addr())
+		go func() {
+			err := newHTTPServer(redirectListener.Addr().String(), redirectToHTTPS(port)).Serve(redirectListener)
+			if err != nil {
+				log.Fatalf("Unable to start HTTP redirect server: %s", err)
+			}
+		}()
+	}
+	httpServer := newHTTPServer(listener.Addr().String(), http.DefaultServeMux)
+	if tlsCert != "" {
+		log.Debugf("About to serve HTTPS at port: %s", port)
+		err = httpServer.ServeTLS(listener, tlsCert, tlsKey)
+	} else {
+		log.Debugf("About to serve at port: %s", port)
+		err = httpServer.Serve(listener)
+	}
 	if err != nil {
 		log.Fatalf("Unable to start HTTP server: %s", err)
 	}
 }
+
+// serverOptions configures the GeoServer from the environment
+func serverOptions() []geoserve.Option {
+	var opts []geoserve.Option
+	if overrideURL := os.Getenv("OVERRIDE_URL"); overrideURL != "" {
+		log.Debugf("Consulting override service at: %s", overrideURL)
+		opts = append(opts, geoserve.WithOverrideURL(overrideURL))
+	}
+	if serverIP := os.Getenv("SERVER_IP"); serverIP != "" {
+		opts = append(opts, geoserve.WithServerIP(serverIP))
+	} else if serverIPURL := os.Getenv("SERVER_IP_URL"); serverIPURL != "" {
+		log.Debugf("Detecting server ip with: %s", serverIPURL)
+		opts = append(opts, geoserve.WithServerIPService(serverIPURL, durationFromEnv("SERVER_IP_TTL", geoserve.DefaultServerIPTTL)))
+	}
+	if editionDBs := os.Getenv("EDITION_DBS"); editionDBs != "" {
+		for _, editionDB := range strings.Split(editionDBs, ",") {
+			opts = append(opts, geoserve.WithEditionFile(strings.TrimSpace(editionDB)))
+		}
+	}
+	if cachePolicy := os.Getenv("CACHE_POLICY"); cachePolicy != "" {
+		opts = append(opts, geoserve.WithCachePolicy(cachePolicy))
+	}
+	opts = append(opts, geoserve.WithCacheTTL(durationFromEnv("CACHE_TTL", 0)))
+	opts = append(opts, geoserve.WithNegativeCacheTTL(durationFromEnv("NEGATIVE_CACHE_TTL", 0)))
+	opts = append(opts, geoserve.WithCacheMaxAge(durationFromEnv("CACHE_MAX_AGE", 0)))
+	cacheSize := intFromEnv("CACHE_SIZE", geoserve.CacheSize)
+	opts = append(opts, geoserve.WithDefaultCacheSize(cacheSize))
+	for _, mode := range []string{geoserve.CacheModeCity, geoserve.CacheModeCountry, geoserve.CacheModeRaw, geoserve.CacheModeBrief, geoserve.CacheModeTimezone} {
+		name := "CACHE_SIZE_" + strings.ToUpper(mode)
+		if os.Getenv(name) != "" {
+			opts = append(opts, geoserve.WithCacheSize(mode, intFromEnv(name, cacheSize)))
+		}
+	}
+	if autoTuneInterval := durationFromEnv("CACHE_AUTOTUNE_INTERVAL", 0); autoTuneInterval > 0 {
+		opts = append(opts, geoserve.WithCacheAutoTune(geoserve.CacheAutoTune{
+			Interval:       autoTuneInterval,
+			MinSize:        intFromEnv("CACHE_AUTOTUNE_MIN_SIZE", 1000),
+			MaxSize:        intFromEnv("CACHE_AUTOTUNE_MAX_SIZE", 1000000),
+			TargetHitRate:  floatFromEnv("CACHE_AUTOTUNE_TARGET_HIT_RATE", 0.9),
+			MaxMemoryBytes: uint64(intFromEnv("CACHE_AUTOTUNE_MAX_MEMORY_MB", 512)) << 20,
+		}))
+	}
+	opts = append(opts, geoserve.WithMaxUpdateAge(durationFromEnv("HEALTH_MAX_UPDATE_AGE", geoserve.DefaultMaxUpdateAge)))
+	if fallbackDB := os.Getenv("DB_FALLBACK"); fallbackDB != "" {
+		opts = append(opts, geoserve.WithFallbackDB(fallbackDB))
+	}
+	opts = append(opts, geoserve.WithDBWait(durationFromEnv("DB_WAIT_TIMEOUT", 0)))
+	opts = append(opts, geoserve.WithDBFileRetry(intFromEnv("DB_LOAD_ATTEMPTS", 1), durationFromEnv("DB_LOAD_RETRY_INTERVAL", 5*time.Second)))
+	opts = append(opts, geoserve.WithDBRefresh(durationFromEnv("DB_REFRESH_INTERVAL", geoserve.DefaultDBRefreshInterval), durationFromEnv("DB_RETRY_INTERVAL", geoserve.DefaultDBRetryInterval)))
+	if dbType := os.Getenv("DB_TYPE"); dbType != "" {
+		opts = append(opts, geoserve.WithDBType(dbType))
+	}
+	if dbURLs := os.Getenv("DB_URLS"); dbURLs != "" {
+		urls := make(map[string]string)
+		for _, pair := range strings.Split(dbURLs, ",") {
+			dbType, url, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok {
+				log.Fatalf("DB_URLS must be comma-separated <type>=<url> pairs, got %q", pair)
+			}
+			urls[dbType] = url
+		}
+		opts = append(opts, geoserve.WithDBURLs(urls))
+	}
+	if anonymousDB, anonymousDBURL := os.Getenv("ANONYMOUS_DB"), os.Getenv("ANONYMOUS_DB_URL"); anonymousDB != "" || anonymousDBURL != "" {
+		opts = append(opts, geoserve.WithAnonymousDB(anonymousDB, anonymousDBURL))
+	}
+	if dbCacheDir := os.Getenv("DB_CACHE_DIR"); dbCacheDir != "" {
+		opts = append(opts, geoserve.WithDBCacheDir(dbCacheDir))
+	}
+	opts = append(opts, geoserve.WithCacheChurnInterval(durationFromEnv("CACHE_CHURN_INTERVAL", 5*time.Minute)))
+	if os.Getenv("LOG_REQUESTS") == "true" {
+		opts = append(opts, geoserve.WithRequestLogging())
+	}
+	if os.Getenv("STALE_ON_ERROR") == "true" {
+		opts = append(opts, geoserve.WithStaleOnError())
+	}
+	if ipListsFile := os.Getenv("IP_LISTS"); ipListsFile != "" {
+		ipLists, err := loadIPLists(ipListsFile)
+		if err != nil {
+			log.Fatalf("Unable to load IP_LISTS: %v", err)
+		}
+		opts = append(opts, geoserve.WithIPLists(ipLists))
+	}
+	opts = append(opts, geoserve.WithMaxPathLength(intFromEnv("MAX_PATH_LENGTH", geoserve.DefaultMaxPathLength)))
+	if os.Getenv("NEAREST_CITY") == "true" {
+		opts = append(opts, geoserve.WithNearestCity())
+	}
+	opts = append(opts, geoserve.WithLookupTimeout(durationFromEnv("LOOKUP_TIMEOUT", 0)))
+	opts = append(opts, geoserve.WithMaxCIDRAddresses(uint64(intFromEnv("MAX_CIDR_ADDRESSES", geoserve.DefaultMaxCIDRAddresses))))
+	opts = append(opts, geoserve.WithMaxInFlight(intFromEnv("MAX_IN_FLIGHT", 0)))
+	if maxInFlight := intFromEnv("SHED_MAX_IN_FLIGHT", 0); maxInFlight > 0 {
+		opts = append(opts, geoserve.WithLoadShedding(durationFromEnv("SHED_WINDOW", time.Minute), maxInFlight, floatFromEnv("SHED_FRACTION", 0.5)))
+	}
+	if allowClientCIDRs := os.Getenv("ALLOW_CLIENT_CIDRS"); allowClientCIDRs != "" {
+		var cidrs []string
+		for _, cidr := range strings.Split(allowClientCIDRs, ",") {
+			cidrs = append(cidrs, strings.TrimSpace(cidr))
+		}
+		opts = append(opts, geoserve.WithAllowedClientCIDRs(cidrs))
+	}
+	if trustedProxies := os.Getenv("TRUSTED_PROXIES"); trustedProxies != "" {
+		var cidrs []string
+		for _, cidr := range strings.Split(trustedProxies, ",") {
+			cidrs = append(cidrs, strings.TrimSpace(cidr))
+		}
+		opts = append(opts, geoserve.WithTrustedProxies(cidrs))
+	}
+	opts = append(opts, geoserve.WithConfidenceWeights(geoserve.ConfidenceWeights{
+		Accuracy: floatFromEnv("CONFIDENCE_WEIGHT_ACCURACY", geoserve.DefaultConfidenceWeights.Accuracy),
+		City:     floatFromEnv("CONFIDENCE_WEIGHT_CITY", geoserve.DefaultConfidenceWeights.City),
+		Country:  floatFromEnv("CONFIDENCE_WEIGHT_COUNTRY", geoserve.DefaultConfidenceWeights.Country),
+	}))
+	if defaultCase := os.Getenv("DEFAULT_CASE"); defaultCase != "" {
+		opts = append(opts, geoserve.WithDefaultCase(defaultCase))
+	}
+	if os.Getenv("EXPLICIT_UNKNOWN") == "true" {
+		opts = append(opts, geoserve.WithExplicitUnknown())
+	}
+	if os.Getenv("REFLECT_IP") == "false" {
+		opts = append(opts, geoserve.WithoutReflectedIP())
+	}
+	opts = append(opts, geoserve.WithPrivateIPStatus(intFromEnv("PRIVATE_IP_STATUS", 0)))
+	if defaultLang := os.Getenv("DEFAULT_LANG"); defaultLang != "" {
+		log.Debugf("Collapsing names to: %s", defaultLang)
+		opts = append(opts, geoserve.WithDefaultLang(defaultLang))
+	}
+	return opts
+}
+
+// listen validates port and binds to it on the interface with bindAddr, or
+// on all interfaces if bindAddr is ""
+func listen(name string, bindAddr string, port string) (net.Listener, error) {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return nil, fmt.Errorf("%v must be an integer between 1 and 65535, got %q", name, port)
+	}
+	addr := net.JoinHostPort(bindAddr, port)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen at %v, is it already in use? %v", addr, err)
+	}
+	return listener, nil
+}
+
+// loadIPLists loads named lists of ips from a JSON file like
+// {"egress": ["1.2.3.4", "5.6.7.8"]}
+func loadIPLists(filename string) (map[string][]string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var ipLists map[string][]string
+	err = json.Unmarshal(data, &ipLists)
+	if err != nil {
+		return nil, err
+	}
+	return ipLists, nil
+}
+
+// handleDebugUI serves a minimal HTML page for looking up ips by hand
+func handleDebugUI(resp http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" {
+		http.NotFound(resp, req)
+		return
+	}
+	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := debugTemplate.Execute(resp, map[string]string{"LookupPath": "/lookup/"})
+	if err != nil {
+		log.Errorf("Unable to render debug UI: %v", err)
+	}
+}